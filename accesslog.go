@@ -0,0 +1,236 @@
+package wuppo
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LogFormat is the line format of AccessLogFormat.
+type LogFormat int
+
+const (
+	// LogFormatCommon is the NCSA Common Log Format.
+	LogFormatCommon LogFormat = iota + 1
+
+	// LogFormatCombined is the NCSA Combined Log Format, the Common Log
+	// Format plus referer and user agent.
+	LogFormatCombined
+
+	// LogFormatJSON writes one JSON object per line.
+	LogFormatJSON
+)
+
+// accessEntry holds the data of one access log entry.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	URI       string    `json:"-"` // with query, for the request line only
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	RequestID string    `json:"requestId"`
+	Session   string    `json:"session,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// AccessLog returns a HTTPMiddleware that logs every request to logger,
+// with level Info and the attributes method, path, status, bytes,
+// duration, remote, requestId and session. The session attribute is a
+// short hash of the session id, so that requests of a session can be
+// correlated without leaking the id into the log. For the same reason,
+// the path has no query string, which can hold tokens. A Handler created
+// by New installs AccessLog with its logger by default.
+func AccessLog(logger *slog.Logger) HTTPMiddleware {
+	return accessLog(func(ctx context.Context, e *accessEntry) {
+		logger.LogAttrs(ctx, slog.LevelInfo, "request",
+			slog.String("method", e.Method),
+			slog.String("path", e.Path),
+			slog.Int("status", e.Status),
+			slog.Int64("bytes", e.Bytes),
+			slog.Float64("duration", e.Duration),
+			slog.String("remote", e.Remote),
+			slog.String("requestId", e.RequestID),
+			slog.String("session", e.Session),
+		)
+	})
+}
+
+// AccessLogFormat returns a HTTPMiddleware that writes one line per
+// request to out, in the given format. The request line of the Common and
+// Combined formats has the query string, like other web servers log it;
+// the path of the JSON format has not.
+func AccessLogFormat(out io.Writer, format LogFormat) HTTPMiddleware {
+	var mx sync.Mutex
+	return accessLog(func(ctx context.Context, e *accessEntry) {
+		var line []byte
+		switch format {
+		case LogFormatJSON:
+			line, _ = json.Marshal(e)
+		default:
+			bytes := "-"
+			if e.Bytes > 0 {
+				bytes = fmt.Sprint(e.Bytes)
+			}
+			s := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s",
+				e.Remote, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+				e.Method, e.URI, e.Proto, e.Status, bytes)
+			if format == LogFormatCombined {
+				s += fmt.Sprintf(" %q %q", e.Referer, e.UserAgent)
+			}
+			line = []byte(s)
+		}
+		line = append(line, '\n')
+		mx.Lock()
+		defer mx.Unlock()
+		out.Write(line)
+	})
+}
+
+// accessLog returns a HTTPMiddleware that records an accessEntry for every
+// request and passes it to write. It also assigns the request id.
+func accessLog(write func(ctx context.Context, e *accessEntry)) HTTPMiddleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t1 := time.Now()
+			id := r.Header.Get("X-Request-Id")
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set("X-Request-Id", id)
+			rec := &accessRecord{requestID: id}
+			r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, rec))
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			remote := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(remote); err == nil {
+				remote = host
+			}
+			e := &accessEntry{
+				Time:      t1,
+				Remote:    remote,
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				URI:       r.URL.RequestURI(),
+				Proto:     r.Proto,
+				Status:    sw.status,
+				Bytes:     sw.bytes,
+				Duration:  time.Since(t1).Seconds(),
+				RequestID: id,
+				Session:   hashSessionID(rec.sid),
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+			}
+			write(r.Context(), e)
+		})
+	}
+}
+
+// accessRecord is stored in the request context by the access log
+// middleware. The Handler fills in the session id after the ServeFunc ran.
+type accessRecord struct {
+	requestID string
+	sid       string
+}
+
+type accessRecordKey struct{}
+
+// accessRecordOf returns the accessRecord of a request, or nil.
+func accessRecordOf(r *http.Request) *accessRecord {
+	rec, _ := r.Context().Value(accessRecordKey{}).(*accessRecord)
+	return rec
+}
+
+// newRequestID returns a random request id.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// validRequestID returns true if id is a request id that can be taken over
+// from a client or proxy: 1 to 64 letters, digits, dashes or underscores.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// hashSessionID returns a short hash of a session id, or "" if sid is "".
+func hashSessionID(sid string) string {
+	if sid == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString(sum[:6])
+}
+
+// statusWriter is a http.ResponseWriter that records the status code and
+// the number of bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := sw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
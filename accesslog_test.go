@@ -0,0 +1,70 @@
+package wuppo
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func newLoggedHandler(t *testing.T, opts ...Option) *Handler {
+	opts = append([]Option{WithTemplatePattern("")}, opts...)
+	h, err := New(func(req Req) {
+		req.SetSessionValue("name", "chris")
+		req.SetHTML("hello " + req.RequestID())
+	}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	h := newLoggedHandler(t, WithLogger(slog.New(slog.NewJSONHandler(&buf, nil))))
+	r := httptest.NewRequest("GET", "/x?token=secret", nil)
+	r.Header.Set("X-Request-Id", "abc-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.String() != "hello abc-123" {
+		t.Errorf("wrong body %q", w.Body.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["path"] != "/x" || entry["status"] != 200.0 || entry["bytes"] != 13.0 || entry["requestId"] != "abc-123" {
+		t.Errorf("wrong entry %v", entry)
+	}
+	if s, _ := entry["session"].(string); len(s) != 12 {
+		t.Errorf("wanted session hash but was %v", entry["session"])
+	}
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	tests := []struct {
+		format LogFormat
+		re     string
+	}{
+		{LogFormatCommon, `^192\.0\.2\.1 - - \[.+\] "GET /x\?a=1 HTTP/1\.1" 200 \d+\n$`},
+		{LogFormatCombined, `^192\.0\.2\.1 - - \[.+\] "GET /x\?a=1 HTTP/1\.1" 200 \d+ "" "test/1\.0"\n$`},
+		{LogFormatJSON, `^\{"time":.*"path":"/x",.*"status":200,.*"requestId":"[0-9a-f]{16}","session":"[0-9a-f]{12}".*\}\n$`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		h := newLoggedHandler(t, WithoutDefaultMiddleware(), WithHTTPMiddleware(AccessLogFormat(&buf, test.format)))
+		r := httptest.NewRequest("GET", "/x?a=1", nil)
+		r.Header.Set("User-Agent", "test/1.0")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if !regexp.MustCompile(test.re).MatchString(buf.String()) {
+			t.Errorf("format %d: %q does not match %s", test.format, buf.String(), test.re)
+		}
+		if strings.Count(buf.String(), "\n") != 1 {
+			t.Errorf("format %d: wanted one line", test.format)
+		}
+	}
+}
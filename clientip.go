@@ -0,0 +1,176 @@
+package wuppo
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseTrustedProxies parses IP addresses and CIDR ranges, like
+// "10.0.0.1" or "10.0.0.0/8".
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// trusted returns true if ip is the address of a trusted proxy.
+func trusted(ip string, proxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultForwardedHeader is the default request header in which trusted
+// proxies send the client address.
+const DefaultForwardedHeader = "X-Forwarded-For"
+
+// remoteIP returns the IP address of the connection of r.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// clientIP returns the IP address of the client of r. If the request came
+// from a trusted proxy, it is the last address in the forwarded header
+// that is not a trusted proxy. The header is either "Forwarded" (RFC 7239)
+// or a header with a list of addresses, like X-Forwarded-For. Only the
+// header that the proxies set is read, since a client can send the others
+// and the proxies pass them on unchanged.
+func clientIP(r *http.Request, proxies []netip.Prefix, header string) string {
+	ip := remoteIP(r)
+	if !trusted(ip, proxies) {
+		return ip
+	}
+	var chain []string
+	if http.CanonicalHeaderKey(header) == "Forwarded" {
+		chain = forwardedFor(r.Header.Values(header))
+	} else {
+		for _, v := range r.Header.Values(header) {
+			for _, hop := range strings.Split(v, ",") {
+				chain = append(chain, strings.TrimSpace(hop))
+			}
+		}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip = chain[i]
+		if !trusted(ip, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedTLS returns true if r came in over TLS, or from a trusted proxy
+// that received it over TLS. The proxy sends the protocol in the "proto"
+// parameter if header is "Forwarded" (RFC 7239), else in the
+// X-Forwarded-Proto header.
+func forwardedTLS(r *http.Request, proxies []netip.Prefix, header string) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !trusted(remoteIP(r), proxies) {
+		return false
+	}
+	if http.CanonicalHeaderKey(header) == "Forwarded" {
+		// the last element is the one that the proxy appended
+		protos := forwardedParams(r.Header.Values(header), "proto")
+		return len(protos) > 0 && strings.EqualFold(protos[len(protos)-1], "https")
+	}
+	return strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// forwardedFor returns the addresses of the "for" parameters of Forwarded
+// headers (RFC 7239), without ports.
+func forwardedFor(headers []string) []string {
+	chain := forwardedParams(headers, "for")
+	for i, value := range chain {
+		if strings.HasPrefix(value, "[") {
+			// IPv6, like "[2001:db8::1]:4711"
+			value, _, _ = strings.Cut(value[1:], "]")
+		} else if host, _, err := net.SplitHostPort(value); err == nil {
+			value = host
+		}
+		chain[i] = value
+	}
+	return chain
+}
+
+// forwardedParams returns the unquoted values of a parameter of Forwarded
+// headers (RFC 7239), in the order of the elements.
+func forwardedParams(headers []string, param string) []string {
+	var values []string
+	for _, v := range headers {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, param) {
+					values = append(values, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return values
+}
+
+// acceptLanguages returns the language tags of an Accept-Language header,
+// ordered by their quality, without tags with quality zero.
+func acceptLanguages(header string) []string {
+	type language struct {
+		tag string
+		q   float64
+	}
+	var langs []language
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			langs = append(langs, language{tag, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+	tags := make([]string, len(langs))
+	for i, lang := range langs {
+		tags[i] = lang.tag
+	}
+	return tags
+}
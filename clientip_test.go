@@ -0,0 +1,60 @@
+package wuppo
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remote  string
+		header  string
+		headers []string
+		want    string
+	}{
+		{"1.2.3.4:1234", "X-Forwarded-For", nil, "1.2.3.4"},
+		{"1.2.3.4:1234", "X-Forwarded-For", []string{"X-Forwarded-For", "5.6.7.8"}, "1.2.3.4"},
+		{"10.0.0.1:1234", "X-Forwarded-For", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"X-Forwarded-For", "5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"X-Forwarded-For", "6.6.6.6, 5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"X-Forwarded-For", "6.6.6.6", "X-Forwarded-For", "5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"X-Forwarded-For", "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", "X-Forwarded-For", []string{"Forwarded", "for=6.6.6.6", "X-Forwarded-For", "5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", "X-Real-IP", []string{"X-Real-IP", "5.6.7.8", "X-Forwarded-For", "6.6.6.6"}, "5.6.7.8"},
+		{"[::1]:1234", "Forwarded", []string{"Forwarded", `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`}, "192.0.2.60"},
+		{"[::1]:1234", "Forwarded", []string{"Forwarded", `for="198.51.100.17:4711"`, "X-Forwarded-For", "5.6.7.8"}, "198.51.100.17"},
+		{"[::1]:1234", "Forwarded", []string{"Forwarded", `for=unknown`}, "unknown"},
+		{"[::1]:1234", "Forwarded", []string{"Forwarded", `proto=https`, "X-Forwarded-For", "5.6.7.8"}, "::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		for i := 0; i < len(tc.headers); i += 2 {
+			r.Header.Add(tc.headers[i], tc.headers[i+1])
+		}
+		if ip := clientIP(r, proxies, tc.header); ip != tc.want {
+			t.Errorf("%s %s %v: wanted %s but was %s", tc.remote, tc.header, tc.headers, tc.want, ip)
+		}
+	}
+	if _, err := parseTrustedProxies([]string{"10.0.0/8"}); err == nil {
+		t.Errorf("wanted error for invalid proxy")
+	}
+}
+
+func TestAcceptLanguages(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                                  "",
+		"de":                                "de",
+		"en;q=0.5, de-DE, de;q=0.9, fr;q=0": "de-DE,de,en",
+		"en, de":                            "en,de",
+		"*;q=0.1, en;q=bad":                 "en,*",
+	} {
+		if got := strings.Join(acceptLanguages(header), ","); got != want {
+			t.Errorf("%q: wanted %q but was %q", header, want, got)
+		}
+	}
+}
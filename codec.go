@@ -0,0 +1,80 @@
+package wuppo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// A Codec encodes session data for stores that keep sessions outside of
+// the process memory.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// GobCodec encodes session data with encoding/gob. Session values keep
+// their Go types, but every type that is stored as a session value, other
+// than the predeclared types like string and int, must be registered with
+// gob before it is encoded or decoded, for instance in an init function:
+//
+//	func init() {
+//		gob.Register(User{})
+//		gob.Register([]string{})
+//	}
+var GobCodec Codec = gobCodec{}
+
+// JSONCodec encodes session data with encoding/json. No registration is
+// needed, but session values are decoded into the generic JSON types:
+// numbers become float64, objects become map[string]interface{} and
+// arrays become []interface{}.
+var JSONCodec Codec = jsonCodec{}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// codecValue wraps a session value, so that codecs that need type
+// information, like GobCodec, can encode interface values.
+type codecValue struct {
+	V interface{}
+}
+
+// encodeValue encodes a single session value with codec.
+func encodeValue(codec Codec, value interface{}) ([]byte, error) {
+	data, err := codec.Marshal(&codecValue{value})
+	if err != nil {
+		return nil, fmt.Errorf("wuppo: cannot encode session value: %w", err)
+	}
+	return data, nil
+}
+
+// decodeValue decodes a single session value with codec.
+func decodeValue(codec Codec, data []byte) (interface{}, error) {
+	var cv codecValue
+	if err := codec.Unmarshal(data, &cv); err != nil {
+		return nil, fmt.Errorf("wuppo: cannot decode session value: %w", err)
+	}
+	return cv.V, nil
+}
@@ -0,0 +1,83 @@
+package wuppo
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// contentDisposition returns the Content-Disposition header that makes
+// browsers download a response as a file. Non-ASCII file names are
+// encoded as described in RFC 2231.
+func contentDisposition(filename string) string {
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": filename}); v != "" {
+		return v
+	}
+	return "attachment"
+}
+
+// serveFile writes the file at path with http.ServeContent. It responds
+// with the error page for status 404 if the file does not exist or is a
+// directory.
+func (handler *Handler) serveFile(w http.ResponseWriter, r *http.Request, req *reqImpl) error {
+	f, err := os.Open(req.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		handler.serveError(w, r, req, http.StatusNotFound, nil, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		handler.serveError(w, r, req, http.StatusNotFound, nil, nil)
+		return nil
+	}
+	http.ServeContent(w, r, filepath.Base(req.file), info.ModTime(), f)
+	return nil
+}
+
+// streamWriter counts the bytes that a stream response writes.
+type streamWriter struct {
+	w http.ResponseWriter
+	n int64
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.n += int64(n)
+	return n, err
+}
+
+// Flush sends the bytes written so far to the client.
+func (sw *streamWriter) Flush() {
+	if f, ok := sw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveStream writes a stream response. It returns the error of the
+// stream if the stream has written nothing, so the Handler can respond with
+// an error page. Later errors can only be logged, since the response is
+// already on its way.
+func (handler *Handler) serveStream(w http.ResponseWriter, r *http.Request, req *reqImpl) error {
+	sw := &streamWriter{w: w}
+	if req.status != 0 {
+		w.WriteHeader(req.status)
+	}
+	err := req.stream(sw)
+	if err != nil && sw.n == 0 && req.status == 0 {
+		return err
+	}
+	if err != nil {
+		handler.logger.Error("wuppo: cannot stream response", "method", r.Method, "path", r.URL.Path, "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package wuppo
+
+import (
+	"net/http"
+)
+
+// DefaultCookieName is the default name of the session cookie.
+const DefaultCookieName = "WUPPO_SESSION_ID"
+
+// CookieSecure controls the Secure attribute of the session cookie.
+type CookieSecure int
+
+const (
+	// CookieSecureAuto sets the Secure attribute if the request came in
+	// over TLS, or through a trusted proxy that received it over TLS. The
+	// proxy must be listed in WithTrustedProxies, and send the protocol in
+	// the "proto" parameter if the forwarded header is "Forwarded", or
+	// else in the X-Forwarded-Proto header. See WithForwardedHeader.
+	CookieSecureAuto CookieSecure = iota
+
+	// CookieSecureAlways always sets the Secure attribute.
+	CookieSecureAlways
+
+	// CookieSecureNever never sets the Secure attribute.
+	CookieSecureNever
+)
+
+// CookieConfig configures the session cookie. Fields with zero values
+// have defaults. The cookie is always HttpOnly.
+type CookieConfig struct {
+	// Name is the name of the cookie. The default is DefaultCookieName.
+	Name string
+
+	// Domain is the Domain attribute. The default is empty, which
+	// restricts the cookie to the host of the request.
+	Domain string
+
+	// Path is the Path attribute. The default is "/".
+	Path string
+
+	// Secure controls the Secure attribute. The default is
+	// CookieSecureAuto.
+	Secure CookieSecure
+
+	// SameSite is the SameSite attribute. The default is
+	// http.SameSiteLaxMode. Browsers require http.SameSiteNoneMode
+	// cookies to be Secure.
+	SameSite http.SameSite
+
+	// Persistent makes all session cookies last as long as their session,
+	// so sessions survive browser restarts. By default, only sessions with
+	// a lifetime set by Req.SetSessionLifetime are persistent, other
+	// session cookies expire when the browser is closed. It needs a
+	// LifetimeStore, or a RequestStore whose sessions are LifetimeStores.
+	// All stores of this package are one of them: CookieStore is a
+	// RequestStore, the others are LifetimeStores.
+	Persistent bool
+}
+
+// withDefaults returns the config with defaults for zero fields.
+func (cfg CookieConfig) withDefaults() CookieConfig {
+	if cfg.Name == "" {
+		cfg.Name = DefaultCookieName
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.SameSite == 0 {
+		cfg.SameSite = http.SameSiteLaxMode
+	}
+	return cfg
+}
+
+// cookie returns a session cookie for a request that came in over TLS or
+// not.
+func (cfg CookieConfig) cookie(tls bool, value string, maxAge int) *http.Cookie {
+	secure := cfg.Secure == CookieSecureAlways
+	if cfg.Secure == CookieSecureAuto {
+		secure = tls
+	}
+	return &http.Cookie{
+		Name:     cfg.Name,
+		Value:    value,
+		Domain:   cfg.Domain,
+		Path:     cfg.Path,
+		MaxAge:   maxAge,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: cfg.SameSite,
+	}
+}
@@ -0,0 +1,394 @@
+package wuppo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxCookieSize is the maximum size of a cookie, name and value, that
+// browsers are required to accept.
+const MaxCookieSize = 4096
+
+// ErrCookieTooLarge is returned if the session data of a CookieStore
+// does not fit into a cookie of MaxCookieSize bytes.
+var ErrCookieTooLarge = errors.New("wuppo: session cookie too large")
+
+// CookieStore is a SessionStore that keeps the session data in the session
+// cookie itself, so the server keeps no state and requests can be served
+// by any instance of a horizontally scaled application.
+//
+// The session is encoded with a Codec, encrypted with AES-GCM and signed
+// with HMAC-SHA256. The keys are derived from secrets of at least 32
+// bytes. The first secret is used to encode cookies, all secrets are
+// tried to decode them, so secrets can be rotated by putting a new secret
+// first and keeping the old ones until their cookies have expired.
+//
+// CookieStore is a RequestStore: the Handler decodes the cookie once per
+// request and writes the full cookie at the end of the request, before
+// the response is rendered. If the encoded session is larger than
+// MaxCookieSize, the request fails with ErrCookieTooLarge, so keep
+// session values small.
+//
+// Since the sessions are not stored on the server, they cannot be listed
+// or expired from outside: GetSessionInfos returns no sessions, and
+// ExpireSessions, TouchSession and KillSession do nothing. Requests
+// check the expiry of their session, and Req.KillSession deletes the
+// cookie.
+type CookieStore struct {
+	codec       Codec
+	keys        []cookieKey
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+}
+
+// cookieKey holds the keys derived from a secret.
+type cookieKey struct {
+	aead    cipher.AEAD
+	hmacKey []byte
+}
+
+// cookieSession is the content of a session cookie.
+type cookieSession struct {
+	Ctime       time.Time
+	Atime       time.Time
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	Persistent  bool
+	Values      map[string]interface{}
+}
+
+// NewCookieStore creates a new CookieStore that encodes sessions with
+// codec and encrypts them with keys derived from secrets. If codec is nil,
+// it uses GobCodec. It returns an error if there is no secret, or if a
+// secret is shorter than 32 bytes.
+func NewCookieStore(codec Codec, secrets ...[]byte) (*CookieStore, error) {
+	if codec == nil {
+		codec = GobCodec
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("wuppo: cookie store needs a secret")
+	}
+	st := &CookieStore{
+		codec:       codec,
+		idleTimeout: 30 * time.Minute,
+	}
+	for _, secret := range secrets {
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("wuppo: cookie store secret must have at least 32 bytes but has %d", len(secret))
+		}
+		block, err := aes.NewCipher(deriveKey(secret, "wuppo encrypt"))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		st.keys = append(st.keys, cookieKey{aead, deriveKey(secret, "wuppo sign")})
+	}
+	return st, nil
+}
+
+// deriveKey derives a 32 byte key for a purpose from a secret.
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// SetIdleTimeout sets the time after which a session expires if it is not
+// accessed. The default is 30 minutes.
+func (st *CookieStore) SetIdleTimeout(d time.Duration) {
+	st.idleTimeout = d
+}
+
+// SetMaxLifetime sets the time after which a session expires, no matter
+// how often it is accessed. The default is 0, which means no maximum.
+func (st *CookieStore) SetMaxLifetime(d time.Duration) {
+	st.maxLifetime = d
+}
+
+// expiry returns the time at which a session expires.
+func (st *CookieStore) expiry(s *cookieSession) time.Time {
+	return expiryOf(s.Ctime, s.Atime, st.idleTimeout, st.maxLifetime, s.IdleTimeout, s.MaxLifetime)
+}
+
+// newSession returns a new, empty session.
+func (st *CookieStore) newSession() *cookieSession {
+	now := time.Now()
+	return &cookieSession{
+		Ctime:  now,
+		Atime:  now,
+		Values: make(map[string]interface{}),
+	}
+}
+
+// encode encodes, encrypts and signs a session into a cookie value.
+func (st *CookieStore) encode(s *cookieSession) (string, error) {
+	data, err := st.codec.Marshal(s)
+	if err != nil {
+		return "", fmt.Errorf("wuppo: cannot encode session: %w", err)
+	}
+	key := st.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload := key.aead.Seal(nonce, nonce, data, nil)
+	mac := hmac.New(sha256.New, key.hmacKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(payload)), nil
+}
+
+// decode verifies, decrypts and decodes a cookie value. It returns nil if
+// the value is invalid or the session has expired.
+func (st *CookieStore) decode(value string) *cookieSession {
+	buf, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(buf) < sha256.Size {
+		return nil
+	}
+	payload, sum := buf[:len(buf)-sha256.Size], buf[len(buf)-sha256.Size:]
+	for _, key := range st.keys {
+		mac := hmac.New(sha256.New, key.hmacKey)
+		mac.Write(payload)
+		if !hmac.Equal(sum, mac.Sum(nil)) {
+			continue
+		}
+		n := key.aead.NonceSize()
+		if len(payload) < n {
+			return nil
+		}
+		data, err := key.aead.Open(nil, payload[:n], payload[n:], nil)
+		if err != nil {
+			return nil
+		}
+		s := &cookieSession{}
+		if err := st.codec.Unmarshal(data, s); err != nil {
+			return nil
+		}
+		if s.Values == nil {
+			s.Values = make(map[string]interface{})
+		}
+		if time.Now().After(st.expiry(s)) {
+			return nil
+		}
+		return s
+	}
+	return nil
+}
+
+// checkCookieSize returns ErrCookieTooLarge if a cookie is larger than
+// MaxCookieSize.
+func checkCookieSize(name string, value string) error {
+	if size := len(name) + 1 + len(value); size > MaxCookieSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d bytes", ErrCookieTooLarge, size, MaxCookieSize)
+	}
+	return nil
+}
+
+// ExpireSessions does nothing, since sessions are not stored on the
+// server. Expired session cookies are rejected when they are decoded.
+func (st *CookieStore) ExpireSessions() {}
+
+// selfExpiring tells the Handler that it needs no janitor for this store.
+func (st *CookieStore) selfExpiring() {}
+
+// TouchSession does nothing, since a request writes the cookie with a new
+// access time when it is needed.
+func (st *CookieStore) TouchSession(sid string) {}
+
+// KillSession does nothing, since sessions are not stored on the server.
+// Req.KillSession deletes the session cookie.
+func (st *CookieStore) KillSession(sid string) {}
+
+// PutValue puts a value into the session encoded in the cookie value sid
+// and returns the new cookie value. If sid is not a valid session, it
+// creates a new session. It panics if the session cannot be encoded.
+func (st *CookieStore) PutValue(sid string, key string, value interface{}) string {
+	s := st.decode(sid)
+	if s == nil {
+		s = st.newSession()
+	}
+	s.Values[key] = value
+	sid, err := st.encode(s)
+	if err == nil {
+		err = checkCookieSize("", sid)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return sid
+}
+
+// GetValue returns a value of the session encoded in the cookie value sid.
+// If the session or the key does not exist, it returns nil.
+func (st *CookieStore) GetValue(sid string, key string) interface{} {
+	if s := st.decode(sid); s != nil {
+		return s.Values[key]
+	}
+	return nil
+}
+
+// GetSessionInfos returns an empty map, since sessions are not stored on
+// the server.
+func (st *CookieStore) GetSessionInfos() map[string]map[string]interface{} {
+	return make(map[string]map[string]interface{})
+}
+
+// LoadSession decodes the session cookie value of a request. An invalid
+// or expired cookie is deleted when the session is committed.
+func (st *CookieStore) LoadSession(value string) RequestSession {
+	cs := &cookieRequest{st: st, value: value, sid: value}
+	if value != "" {
+		cs.s = st.decode(value)
+		cs.dirty = cs.s == nil
+	}
+	return cs
+}
+
+// cookieRequest is the session of a request of a CookieStore. Its
+// session id is the cookie value it was loaded with, or a random id for
+// a session that was created or renamed by the request.
+type cookieRequest struct {
+	st    *CookieStore
+	value string // the cookie value of the request
+	sid   string
+	s     *cookieSession
+	dirty bool // the cookie must be written
+}
+
+// session returns the session if sid is its id, or nil.
+func (cs *cookieRequest) session(sid string) *cookieSession {
+	if sid == "" || sid != cs.sid {
+		return nil
+	}
+	return cs.s
+}
+
+// touch sets the access time of the session and marks the cookie to be
+// written.
+func (cs *cookieRequest) touch() {
+	cs.s.Atime = time.Now()
+	cs.dirty = true
+}
+
+func (cs *cookieRequest) ExpireSessions() {}
+
+// TouchSession sets the access time once a minute, so the cookie is not
+// written with every request.
+func (cs *cookieRequest) TouchSession(sid string) {
+	if s := cs.session(sid); s != nil && time.Since(s.Atime) > time.Minute {
+		cs.touch()
+	}
+}
+
+// KillSession deletes the cookie, if the request has sent one.
+func (cs *cookieRequest) KillSession(sid string) {
+	if cs.session(sid) != nil {
+		cs.s = nil
+		cs.dirty = cs.value != ""
+	}
+}
+
+func (cs *cookieRequest) PutValue(sid string, key string, value interface{}) string {
+	if cs.session(sid) == nil {
+		cs.s = cs.st.newSession()
+		cs.sid = newSessionID()
+	}
+	cs.s.Values[key] = value
+	cs.touch()
+	return cs.sid
+}
+
+func (cs *cookieRequest) GetValue(sid string, key string) interface{} {
+	if s := cs.session(sid); s != nil {
+		return s.Values[key]
+	}
+	return nil
+}
+
+// GetSessionInfos returns the session of the request only.
+func (cs *cookieRequest) GetSessionInfos() map[string]map[string]interface{} {
+	infos := make(map[string]map[string]interface{})
+	if cs.s != nil {
+		info := map[string]interface{}{"_sid": cs.sid}
+		for key, value := range cs.s.Values {
+			info[key] = value
+		}
+		infos[cs.sid] = info
+	}
+	return infos
+}
+
+func (cs *cookieRequest) SetSessionLifetime(sid string, idleTimeout time.Duration, maxLifetime time.Duration) {
+	if s := cs.session(sid); s != nil {
+		s.IdleTimeout = idleTimeout
+		s.MaxLifetime = maxLifetime
+		s.Persistent = true
+		cs.touch()
+	}
+}
+
+func (cs *cookieRequest) TouchSessionExpiry(sid string) (time.Time, bool) {
+	cs.TouchSession(sid)
+	return cs.SessionExpiry(sid)
+}
+
+func (cs *cookieRequest) SessionExpiry(sid string) (time.Time, bool) {
+	s := cs.session(sid)
+	if s == nil {
+		return time.Time{}, false
+	}
+	return cs.st.expiry(s), s.Persistent
+}
+
+// RenameSession gives the session a new id. The new cookie value holds
+// the session, the old value never holds anything written after this
+// point.
+func (cs *cookieRequest) RenameSession(sid string) string {
+	if cs.session(sid) == nil {
+		return ""
+	}
+	cs.sid = newSessionID()
+	cs.touch()
+	return cs.sid
+}
+
+func (cs *cookieRequest) DeleteValue(sid string, key string) {
+	if s := cs.session(sid); s != nil {
+		if _, ok := s.Values[key]; ok {
+			delete(s.Values, key)
+			cs.touch()
+		}
+	}
+}
+
+func (cs *cookieRequest) GetKeys(sid string) []string {
+	if s := cs.session(sid); s != nil {
+		return sortedKeys(s.Values)
+	}
+	return nil
+}
+
+// Commit encodes the session into a new cookie value.
+func (cs *cookieRequest) Commit() (string, bool, error) {
+	if !cs.dirty {
+		return "", false, nil
+	}
+	cs.dirty = false
+	if cs.s == nil {
+		return "", true, nil
+	}
+	value, err := cs.st.encode(cs.s)
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
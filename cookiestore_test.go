@@ -0,0 +1,131 @@
+package wuppo
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCookieStore(t *testing.T) {
+	oldSecret := bytes.Repeat([]byte("o"), 32)
+	newSecret := bytes.Repeat([]byte("n"), 32)
+	if _, err := NewCookieStore(nil, []byte("short")); err == nil {
+		t.Errorf("wanted error for short secret")
+	}
+	oldStore, err := NewCookieStore(nil, oldSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sid-based access
+	value := oldStore.PutValue("", "name", "chris")
+	if v := oldStore.GetValue(value, "name"); v != "chris" {
+		t.Errorf("wanted chris but was %v", v)
+	}
+	if v := oldStore.GetValue(value[:len(value)-2]+"AA", "name"); v != nil {
+		t.Errorf("wanted nil for tampered cookie but was %v", v)
+	}
+	// rotated secrets decode old cookies
+	store, err := NewCookieStore(nil, newSecret, oldSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := store.GetValue(value, "name"); v != "chris" {
+		t.Errorf("wanted chris with rotated secrets but was %v", v)
+	}
+	newStore, _ := NewCookieStore(nil, newSecret)
+	if v := oldStore.GetValue(newStore.PutValue("", "name", "chris"), "name"); v != nil {
+		t.Errorf("wanted nil for unknown secret but was %v", v)
+	}
+}
+
+func TestCookieStoreHandler(t *testing.T) {
+	store, err := NewCookieStore(JSONCodec, bytes.Repeat([]byte("s"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := New(func(req Req) {
+		switch req.Path() {
+		case "/login":
+			req.SetSessionValue("name", req.FormValue("name"))
+			req.SetSessionValue("role", "user")
+		case "/logout":
+			req.KillSession()
+		case "/big":
+			req.SetSessionValue("big", strings.Repeat("x", MaxCookieSize))
+		}
+		name, _ := req.SessionValue("name").(string)
+		req.SetHTML("hello " + name)
+	}, WithSessionStore(store), WithTemplatePattern(""), WithoutDefaultMiddleware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	serve := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := serve("/login?name=chris", nil)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "WUPPO_SESSION_ID" {
+		t.Fatalf("wanted one session cookie but was %v", cookies)
+	}
+	cookie := cookies[0]
+	w = serve("/", cookie)
+	if w.Body.String() != "hello chris" {
+		t.Errorf("wrong body %q", w.Body.String())
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("wanted no cookie for unchanged session")
+	}
+	w = serve("/logout", cookie)
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge != -1 {
+		t.Errorf("wanted deleted cookie but was %v", cookies)
+	}
+	w = serve("/big", cookie)
+	if w.Code != 500 || len(w.Result().Cookies()) != 0 {
+		t.Errorf("wanted 500 without cookie but was %d %v", w.Code, w.Result().Cookies())
+	}
+}
+
+func TestCookieStoreLoadSession(t *testing.T) {
+	store, err := NewCookieStore(nil, bytes.Repeat([]byte("s"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rs RequestStore = store
+	s := rs.LoadSession("")
+	sid := s.PutValue("", "name", "chris")
+	value, changed, err := s.Commit()
+	if err != nil || !changed || value == "" {
+		t.Fatalf("wanted new cookie but was %q %v %v", value, changed, err)
+	}
+	if _, changed, _ := s.Commit(); changed {
+		t.Errorf("wanted no change after commit")
+	}
+	if s.GetValue(sid, "name") != "chris" || s.GetValue("other", "name") != nil {
+		t.Errorf("wrong values")
+	}
+	s = rs.LoadSession(value)
+	s.TouchSession(value)
+	if s.GetValue(value, "name") != "chris" {
+		t.Errorf("wanted chris")
+	}
+	if _, changed, _ := s.Commit(); changed {
+		t.Errorf("wanted no change for a recent session")
+	}
+	s.KillSession(value)
+	if value, changed, _ := s.Commit(); !changed || value != "" {
+		t.Errorf("wanted deleted cookie but was %q %v", value, changed)
+	}
+	s = rs.LoadSession("invalid")
+	if value, changed, _ := s.Commit(); !changed || value != "" {
+		t.Errorf("wanted deleted cookie for invalid value but was %q %v", value, changed)
+	}
+}
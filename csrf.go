@@ -0,0 +1,131 @@
+package wuppo
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"html"
+	"html/template"
+	"strings"
+)
+
+// DefaultCSRFField is the default name of the form field with the CSRF
+// token.
+const DefaultCSRFField = "csrf_token"
+
+// DefaultCSRFHeader is the default name of the request header with the
+// CSRF token.
+const DefaultCSRFHeader = "X-CSRF-Token"
+
+// csrfKey is the session key of the CSRF token.
+const csrfKey = "_csrf"
+
+// CSRFConfig configures the protection against cross-site request
+// forgery. Fields with zero values have defaults.
+//
+// The Handler stores a random token in the session, and rejects requests
+// with an unsafe method, like POST, that do not send this token, with the
+// error page for status 403. Templates send the token in forms with the
+// function csrfField:
+//
+//	<form method="POST">
+//		{{csrfField}}
+//		...
+//	</form>
+//
+// Scripts send it in a request header, for instance from a meta tag that
+// is rendered with the function csrfToken:
+//
+//	<meta name="csrf-token" content="{{csrfToken}}">
+type CSRFConfig struct {
+	// FieldName is the name of the form field with the token. The default
+	// is DefaultCSRFField.
+	FieldName string
+
+	// HeaderName is the name of the request header with the token. The
+	// default is DefaultCSRFHeader.
+	HeaderName string
+
+	// Exempt lists the paths that are not checked, for instance API routes
+	// that do not authenticate with the session cookie. A path that ends
+	// with a slash exempts all paths below it, like "/api/".
+	Exempt []string
+}
+
+// csrf checks the CSRF tokens of requests.
+type csrf struct {
+	cfg    CSRFConfig
+	marker []byte
+}
+
+// newCSRF creates a csrf with a config.
+func newCSRF(cfg CSRFConfig) *csrf {
+	if cfg.FieldName == "" {
+		cfg.FieldName = DefaultCSRFField
+	}
+	if cfg.HeaderName == "" {
+		cfg.HeaderName = DefaultCSRFHeader
+	}
+	// templates are parsed once for all requests, so they render a
+	// marker, which is replaced by the token of the request afterwards
+	return &csrf{cfg, []byte("wuppocsrf" + newSessionID())}
+}
+
+// funcs returns a copy of funcmap with the template functions csrfField
+// and csrfToken.
+func (c *csrf) funcs(funcmap template.FuncMap) template.FuncMap {
+	funcs := make(template.FuncMap, len(funcmap)+2)
+	for name, f := range funcmap {
+		funcs[name] = f
+	}
+	field := template.HTML(`<input type="hidden" name="` + html.EscapeString(c.cfg.FieldName) + `" value="` + string(c.marker) + `">`)
+	funcs["csrfField"] = func() template.HTML {
+		return field
+	}
+	funcs["csrfToken"] = func() string {
+		return string(c.marker)
+	}
+	return funcs
+}
+
+// insertToken replaces the markers in a rendered page with the token of
+// req. It creates the token only if the page has a marker.
+func (c *csrf) insertToken(page []byte, req Req) []byte {
+	if !bytes.Contains(page, c.marker) {
+		return page
+	}
+	return bytes.ReplaceAll(page, c.marker, []byte(req.CSRFToken()))
+}
+
+// exempt returns true if path is not checked.
+func (c *csrf) exempt(path string) bool {
+	for _, p := range c.cfg.Exempt {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns true if the request has a safe method, has an exempt
+// path, or sends the token of its session in the header or in the form
+// content.
+func (c *csrf) check(req *reqImpl) bool {
+	switch req.r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	if c.exempt(req.r.URL.Path) {
+		return true
+	}
+	want, _ := req.SessionValue(csrfKey).(string)
+	if want == "" {
+		return false
+	}
+	// tokens in the query string would leak through logs and Referer
+	// headers, so they are not accepted
+	got := req.r.Header.Get(c.cfg.HeaderName)
+	if got == "" {
+		got = req.r.PostFormValue(c.cfg.FieldName)
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
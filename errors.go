@@ -0,0 +1,157 @@
+package wuppo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+)
+
+// errorPage renders the response for an error status code, either with a
+// template or with a ServeFunc.
+type errorPage struct {
+	template string
+	serve    ServeFunc
+}
+
+// SetErrorTemplate sets the template that renders the response for a
+// status code. Code 0 sets the template for all codes that have no error
+// page of their own. The model of the template contains the values that
+// were set by the ServeFunc, plus "status" (the status code) and
+// "statusText" (its text).
+func (handler *Handler) SetErrorTemplate(code int, template string) {
+	handler.errorPages[code] = errorPage{template: template}
+}
+
+// SetErrorServe sets the ServeFunc that renders the response for a status
+// code. Code 0 sets the ServeFunc for all codes that have no error page of
+// their own. The ServeFunc must set a HTML or a template response. The
+// model contains "status" (the status code) and "statusText" (its text).
+func (handler *Handler) SetErrorServe(code int, serve ServeFunc) {
+	handler.errorPages[code] = errorPage{serve: serve}
+}
+
+// serveError responds with the error page for code. If no error page was
+// set for code, it responds with the status text. The cause is non-nil if
+// the error was caused by a panic or a rendering error, stack is the
+// stack trace of a panic. In development mode, errors with a cause are
+// shown on a detailed developer error page. The req may be nil, or have
+// a session that failed to load.
+func (handler *Handler) serveError(w http.ResponseWriter, r *http.Request, req *reqImpl, code int, cause error, stack []byte) {
+	if req == nil {
+		req = newReqImpl(w, r, handler)
+	}
+	if cause != nil || code != req.status {
+		// the request failed, the headers it set belong to the response
+		// it could not send
+		req.discardHeaders()
+	}
+	if handler.dev && cause != nil {
+		handler.serveDevError(w, r, req, code, cause, stack)
+		return
+	}
+	page, ok := handler.errorPages[code]
+	if !ok {
+		page, ok = handler.errorPages[0]
+	}
+	if ok {
+		html, err := handler.renderErrorPage(page, req, code)
+		if err == nil {
+			// the page can have added values to the session
+			if err := req.commitSession(); err != nil {
+				handler.logger.Error("wuppo: cannot write session cookie", "method", r.Method, "path", r.URL.Path, "err", err)
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(code)
+			w.Write(html)
+			return
+		}
+		handler.logger.Error("wuppo: cannot render error page", "status", code, "err", err)
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+// renderErrorPage renders an error page into a byte slice.
+func (handler *Handler) renderErrorPage(page errorPage, req *reqImpl, code int) (html []byte, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	req.model["status"] = code
+	req.model["statusText"] = http.StatusText(code)
+	name := page.template
+	if page.serve != nil {
+		req.html = ""
+		req.template = ""
+		page.serve(req)
+		if req.html != "" {
+			return []byte(req.html), nil
+		}
+		name = req.template
+	}
+	if name == "" {
+		return nil, errors.New("error page has neither a HTML nor a template response")
+	}
+	return handler.execute(req, name)
+}
+
+// serveDevError responds with the developer error page.
+func (handler *Handler) serveDevError(w http.ResponseWriter, r *http.Request, req *reqImpl, code int, cause error, stack []byte) {
+	dump, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		dump = []byte(err.Error())
+	}
+	keys := make([]string, 0, len(req.model))
+	for key := range req.model {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	model := make([]string, 0, len(keys))
+	for _, key := range keys {
+		model = append(model, fmt.Sprintf("%s = %#v", key, req.model[key]))
+	}
+	data := map[string]interface{}{
+		"status":     code,
+		"statusText": http.StatusText(code),
+		"error":      cause.Error(),
+		"stack":      string(stack),
+		"request":    string(dump),
+		"model":      model,
+	}
+	var buf bytes.Buffer
+	if err := devErrorTemplate.Execute(&buf, data); err != nil {
+		http.Error(w, cause.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
+var devErrorTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.status}} {{.statusText}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #eee; padding: 1em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>{{.status}} {{.statusText}}</h1>
+<pre>{{.error}}</pre>
+{{with .stack}}<h2>Stack</h2>
+<pre>{{.}}</pre>{{end}}
+<h2>Request</h2>
+<pre>{{.request}}</pre>
+<h2>Model</h2>
+<pre>{{range .model}}{{.}}
+{{end}}</pre>
+</body>
+</html>
+`))
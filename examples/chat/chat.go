@@ -40,8 +40,6 @@ func (db *Db) GetMessages() []string {
 //
 
 func serveIndex(req wuppo.Req) {
-	reason := req.FormValue("reason")
-	req.SetModelValue("reason", reason)
 	if req.IsGet() {
 		req.SetTemplate("index.html")
 		return
@@ -53,6 +51,8 @@ func serveIndex(req wuppo.Req) {
 		req.SetTemplate("index.html")
 		return
 	}
+	// a new session id for the logged in user, against session fixation
+	req.RegenerateSession()
 	req.SetSessionValue("name", name)
 	req.SetRedirect("/chat")
 }
@@ -63,9 +63,10 @@ func serveLogout(req wuppo.Req) {
 }
 
 func serveChat(req wuppo.Req) {
-	name := req.SessionValue("name").(string)
+	name, _ := wuppo.SessionGet[string](req, "name")
 	if name == "" {
-		req.SetRedirect("/?reason=notLoggedIn")
+		req.AddFlash("error", "You are not logged in or your session has expired")
+		req.SetRedirect("/")
 		return
 	}
 	req.SetModelValue("name", name)
@@ -86,30 +87,34 @@ func serveSessions(req wuppo.Req) {
 	req.SetTemplate("sessions.html")
 }
 
-func serve(req wuppo.Req) {
-	switch req.Path() {
-	case "/":
-		serveIndex(req)
-	case "/logout":
-		serveLogout(req)
-	case "/chat":
-		serveChat(req)
-	case "/sessions":
-		serveSessions(req)
-	default:
-		req.SetStatus(http.StatusNotFound)
-	}
-}
-
-//
 // globals
-//
 var theSessionStore = wuppo.NewMemStore()
 var theDb = NewDb()
+var theRouter = newRouter()
+
+func newRouter() *wuppo.Router {
+	router := wuppo.NewRouter()
+	router.Get("/", serveIndex)
+	router.Post("/", serveIndex)
+	router.Get("/logout", serveLogout)
+	router.Get("/chat", serveChat)
+	router.Post("/chat", serveChat)
+	router.Get("/sessions", serveSessions)
+	return router
+}
 
 func main() {
-	// init wuppo handler
-	http.Handle("/", wuppo.NewHandler(serve, theSessionStore, "*.html", nil))
+	// init wuppo handler, re-parse templates when they change
+	h, err := wuppo.New(theRouter.Serve,
+		wuppo.WithSessionStore(theSessionStore),
+		wuppo.WithDefaultLayout("layout.html"),
+		wuppo.WithCSRF(wuppo.CSRFConfig{}),
+		wuppo.WithDevMode(true),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/", h)
 	// serve static files (favicon)
 	http.Handle("/favicon.ico", http.FileServer(http.Dir(".")))
 	// for development only: exit if a go file changes
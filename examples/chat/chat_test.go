@@ -9,29 +9,34 @@ import (
 
 func TestGetIndex(t *testing.T) {
 	req := wuppo.NewReqStub("GET", "/")
-	req.FormValueMap["reason"] = "loggedOut"
-	serve(req)
-	assert(t, req.ModelMap["reason"] == "loggedOut", "wrong reason", req.ModelMap["reason"])
+	theRouter.Serve(req)
 	assert(t, req.Template == "index.html", "wrong template", req.Template)
 }
 
 func TestPostIndex(t *testing.T) {
 	req := wuppo.NewReqStub("POST", "/")
 	req.FormValueMap["name"] = "CV"
-	serve(req)
+	theRouter.Serve(req)
 	assert(t, req.Redirect == "/chat", "wrong redirect", req.Redirect)
 }
 
 func TestPostIndexWithEmptyName(t *testing.T) {
 	req := wuppo.NewReqStub("POST", "/")
 	req.FormValueMap["name"] = " "
-	serve(req)
+	theRouter.Serve(req)
 	errors := req.ModelMap["errors"].([]string)
 	assert(t, len(errors) == 1, "wrong len errors", len(errors))
 	assert(t, errors[0] == "Name must not be empty", "wrong errors[0]", errors[0])
 	assert(t, req.Template == "index.html", "wrong template", req.Template)
 }
 
+func TestGetChatNotLoggedIn(t *testing.T) {
+	req := wuppo.NewReqStub("GET", "/chat")
+	theRouter.Serve(req)
+	assert(t, req.Redirect == "/", "wrong redirect", req.Redirect)
+	assert(t, len(req.FlashList) == 1, "wrong len flashes", len(req.FlashList))
+}
+
 // ... and so on, you get the idea
 
 func assert(t *testing.T, condition bool, args ...interface{}) {
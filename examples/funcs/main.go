@@ -1,12 +1,19 @@
 package main
 
 import (
+	"embed"
 	"fmt"
 	"github.com/cvilsmeier/wuppo"
 	"log"
 	"net/http"
 )
 
+// the templates are embedded into the binary, so the server can be
+// started from any directory
+//
+//go:embed *.html
+var templates embed.FS
+
 func reverse(s string) string {
 	runes := []rune(s)
 	count := len(runes)
@@ -31,11 +38,16 @@ func serve(req wuppo.Req) {
 
 func main() {
 	// init wuppo handler
-	sessionStore := wuppo.NewMemStore()
 	funcmap := map[string]interface{}{
 		"reverse": reverse,
 	}
-	h := wuppo.NewHandler(serve, sessionStore, "*.html", funcmap)
+	h, err := wuppo.New(serve,
+		wuppo.WithTemplates(templates, "*.html"),
+		wuppo.WithFuncMap(funcmap),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
 	http.Handle("/", h)
 	fmt.Printf("goto http://localhost:8080\n")
 	log.Panic(http.ListenAndServe(":8080", nil))
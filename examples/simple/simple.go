@@ -16,7 +16,11 @@ func main() {
 	// register a default wuppo http.Handler
 	// default means: store session data in memory and
 	// search html templates in current directory
-	http.Handle("/", wuppo.NewDefaultHandler(serve))
+	h, err := wuppo.NewDefaultHandler(serve)
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/", h)
 	// start on port 8080
 	fmt.Printf("server is up, now goto http://localhost:8080\n")
 	log.Fatal(http.ListenAndServe(":8080", nil))
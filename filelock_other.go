@@ -0,0 +1,18 @@
+//go:build !unix
+
+package wuppo
+
+import (
+	"os"
+)
+
+// lockFile does nothing on this platform. Stores that use it are only
+// safe within one process.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlockFile does nothing on this platform.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package wuppo
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile places an advisory lock on f, shared or exclusive. It blocks
+// until the lock is acquired.
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// unlockFile releases the lock on f.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
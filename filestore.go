@@ -0,0 +1,466 @@
+package wuppo
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStore is a SessionStore that stores each HTTP session in a file in
+// a directory, so sessions survive restarts of the process. Sessions are
+// encoded with a Codec; with GobCodec, types of session values must be
+// registered with gob.Register (see GobCodec).
+//
+// Files are written atomically: a session is written to a temporary file
+// that is then renamed over the session file. The last access time of a
+// session is the modification time of its file. Access to the directory
+// is guarded by an advisory lock on a lock file, so several processes can
+// share a directory on platforms that support file locks.
+//
+// FileStore does not expire sessions in the background. ExpireSessions
+// removes the files of expired sessions, so it should be run periodically,
+// which the Handler janitor does by default.
+//
+// A session file that cannot be decoded, for instance after the codec was
+// changed, counts as a missing session and is removed.
+type FileStore struct {
+	dir         string
+	codec       Codec
+	lockfile    *os.File
+	mx          sync.RWMutex
+	readersMx   sync.Mutex
+	readers     int // holders of the shared lock in this process
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+}
+
+// fileSuffix is the file name suffix of session files.
+const fileSuffix = ".session"
+
+// fileRecord is the content of a session file.
+type fileRecord struct {
+	Ctime       time.Time
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	Persistent  bool
+	Values      map[string]interface{}
+}
+
+// NewFileStore creates a new FileStore that stores sessions in dir,
+// encoded with codec. If codec is nil, it uses GobCodec. The directory is
+// created if it does not exist. The store keeps a lock file open, which
+// is released by Close.
+func NewFileStore(dir string, codec Codec) (*FileStore, error) {
+	if codec == nil {
+		codec = GobCodec
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lockfile, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	st := &FileStore{
+		dir:         dir,
+		codec:       codec,
+		lockfile:    lockfile,
+		idleTimeout: 30 * time.Minute,
+	}
+	return st, nil
+}
+
+// Close releases the lock file of the store. The session files are kept.
+func (st *FileStore) Close() error {
+	return st.lockfile.Close()
+}
+
+// SetIdleTimeout sets the time after which a session expires if it is not
+// accessed. The default is 30 minutes.
+func (st *FileStore) SetIdleTimeout(d time.Duration) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.idleTimeout = d
+}
+
+// SetMaxLifetime sets the time after which a session expires, no matter
+// how often it is accessed. The default is 0, which means no maximum.
+func (st *FileStore) SetMaxLifetime(d time.Duration) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.maxLifetime = d
+}
+
+// lock acquires the in-process lock and the lock file, shared or
+// exclusive, and returns a function that releases both. All shared
+// holders in this process share one file lock, which the first one
+// acquires and the last one releases.
+func (st *FileStore) lock(exclusive bool) func() {
+	if exclusive {
+		st.mx.Lock()
+		if err := lockFile(st.lockfile, true); err != nil {
+			st.mx.Unlock()
+			panic(fmt.Errorf("wuppo: cannot lock session store: %w", err))
+		}
+		return func() {
+			unlockFile(st.lockfile)
+			st.mx.Unlock()
+		}
+	}
+	st.mx.RLock()
+	st.readersMx.Lock()
+	if st.readers == 0 {
+		if err := lockFile(st.lockfile, false); err != nil {
+			st.readersMx.Unlock()
+			st.mx.RUnlock()
+			panic(fmt.Errorf("wuppo: cannot lock session store: %w", err))
+		}
+	}
+	st.readers++
+	st.readersMx.Unlock()
+	return func() {
+		st.readersMx.Lock()
+		st.readers--
+		if st.readers == 0 {
+			unlockFile(st.lockfile)
+		}
+		st.readersMx.Unlock()
+		st.mx.RUnlock()
+	}
+}
+
+// path returns the file name of a session, or "" if sid is not a valid
+// session id. Session ids come from cookies, so they are checked before
+// they are used in file names.
+func (st *FileStore) path(sid string) string {
+	if len(sid) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(sid); err != nil {
+		return ""
+	}
+	return filepath.Join(st.dir, sid+fileSuffix)
+}
+
+// expiry returns the time at which a session expires.
+func (st *FileStore) expiry(rec *fileRecord, atime time.Time) time.Time {
+	return expiryOf(rec.Ctime, atime, st.idleTimeout, st.maxLifetime, rec.IdleTimeout, rec.MaxLifetime)
+}
+
+// read reads a session file and returns the session and its last access
+// time. If the file does not exist, it returns nil. If the file cannot be
+// decoded, the error is an errCorruptSession.
+func (st *FileStore) read(path string) (*fileRecord, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	rec := &fileRecord{}
+	if err := st.codec.Unmarshal(data, rec); err != nil {
+		return nil, time.Time{}, fmt.Errorf("%w %s: %v", errCorruptSession, path, err)
+	}
+	if rec.Values == nil {
+		rec.Values = make(map[string]interface{})
+	}
+	return rec, info.ModTime(), nil
+}
+
+// load reads a session that has not expired. It returns nil if the
+// session does not exist or has expired, and panics on I/O errors. A
+// session file that cannot be decoded is removed.
+func (st *FileStore) load(sid string) *fileRecord {
+	rec, _ := st.loadWithAtime(sid)
+	return rec
+}
+
+// loadWithAtime is load, and returns the last access time too.
+func (st *FileStore) loadWithAtime(sid string) (*fileRecord, time.Time) {
+	path := st.path(sid)
+	if path == "" {
+		return nil, time.Time{}
+	}
+	rec, atime, err := st.read(path)
+	if errors.Is(err, errCorruptSession) {
+		// no writer holds the lock, so the file can be removed with a
+		// shared lock too
+		st.remove(path)
+		return nil, time.Time{}
+	}
+	if err != nil {
+		panic(err)
+	}
+	if rec == nil || time.Now().After(st.expiry(rec, atime)) {
+		return nil, time.Time{}
+	}
+	return rec, atime
+}
+
+// write writes a session file atomically. Since the file is replaced,
+// its modification time, and so the last access time of the session, is
+// set to the current time.
+func (st *FileStore) write(sid string, rec *fileRecord) {
+	data, err := st.codec.Marshal(rec)
+	if err != nil {
+		panic(fmt.Errorf("wuppo: cannot encode session: %w", err))
+	}
+	f, err := os.CreateTemp(st.dir, sid+".*.tmp")
+	if err != nil {
+		panic(err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), st.path(sid))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		panic(err)
+	}
+}
+
+// remove removes a session file.
+func (st *FileStore) remove(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+}
+
+// SetSessionLifetime overrides the idle timeout and the maximum lifetime
+// of a session. A zero duration keeps the default of the store.
+func (st *FileStore) SetSessionLifetime(sid string, idleTimeout time.Duration, maxLifetime time.Duration) {
+	defer st.lock(true)()
+	rec := st.load(sid)
+	if rec != nil {
+		rec.IdleTimeout = idleTimeout
+		rec.MaxLifetime = maxLifetime
+		rec.Persistent = true
+		st.write(sid, rec)
+	}
+}
+
+// SessionExpiry returns the time at which a session expires if it is not
+// accessed before, and whether the session is persistent. If the session
+// does not exist, it returns the zero time.
+func (st *FileStore) SessionExpiry(sid string) (time.Time, bool) {
+	defer st.lock(false)()
+	rec, atime := st.loadWithAtime(sid)
+	if rec == nil {
+		return time.Time{}, false
+	}
+	return st.expiry(rec, atime), rec.Persistent
+}
+
+// ExpireSessions removes the files of old sessions. A session is old if
+// it was not accessed within the idle timeout (30 minutes by default), or
+// if it is older than the maximum lifetime (none by default). It also
+// removes files that cannot be decoded, and temporary files that were
+// left behind by crashed processes.
+//
+// Only files that were not modified within the idle timeout of the store
+// are read, so a session that expired earlier, by its maximum lifetime or
+// a shorter idle timeout of its own, is removed once that much time has
+// passed. It cannot be used in between. The files are read without lock,
+// which is safe since they are replaced atomically, so ExpireSessions
+// does not block requests while it reads.
+func (st *FileStore) ExpireSessions() {
+	st.mx.RLock()
+	idle, max := st.idleTimeout, st.maxLifetime
+	st.mx.RUnlock()
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	expired := make(map[string]time.Time) // path -> modification time
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(st.dir, name)
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			if now.Sub(info.ModTime()) > time.Minute {
+				expired[path] = info.ModTime()
+			}
+		case strings.HasSuffix(name, fileSuffix):
+			if now.Sub(info.ModTime()) <= idle {
+				continue
+			}
+			rec, atime, err := st.read(path)
+			if errors.Is(err, errCorruptSession) {
+				expired[path] = info.ModTime()
+			} else if err == nil && rec != nil && now.After(expiryOf(rec.Ctime, atime, idle, max, rec.IdleTimeout, rec.MaxLifetime)) {
+				expired[path] = atime
+			}
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	defer st.lock(true)()
+	for path, mtime := range expired {
+		// a file that was written since it was read is kept
+		if info, err := os.Stat(path); err == nil && info.ModTime().Equal(mtime) {
+			os.Remove(path)
+		}
+	}
+}
+
+// TouchSession sets the atime (last access time) of a session to the
+// current time, much like the unix 'touch' command does with files. It
+// only changes the modification time of the file, so it needs the shared
+// lock only.
+func (st *FileStore) TouchSession(sid string) {
+	st.TouchSessionExpiry(sid)
+}
+
+// TouchSessionExpiry touches a session and returns its new expiry, and
+// whether it is persistent. If the session does not exist, it returns the
+// zero time.
+func (st *FileStore) TouchSessionExpiry(sid string) (time.Time, bool) {
+	defer st.lock(false)()
+	rec := st.load(sid)
+	if rec == nil {
+		return time.Time{}, false
+	}
+	now := time.Now()
+	if err := os.Chtimes(st.path(sid), now, now); err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, false
+		}
+		panic(err)
+	}
+	return st.expiry(rec, now), rec.Persistent
+}
+
+// RenameSession moves the data of a session to a new random session id
+// by renaming its file. It returns the new id, or the empty string if the
+// session does not exist.
+func (st *FileStore) RenameSession(sid string) string {
+	defer st.lock(true)()
+	if st.load(sid) == nil {
+		return ""
+	}
+	newSid := newSessionID()
+	if err := os.Rename(st.path(sid), st.path(newSid)); err != nil {
+		panic(err)
+	}
+	return newSid
+}
+
+// KillSession removes a session.
+func (st *FileStore) KillSession(sid string) {
+	defer st.lock(true)()
+	if path := st.path(sid); path != "" {
+		st.remove(path)
+	}
+}
+
+// PutValue puts a value into a session and returns the session id.
+// If the session with the incoming session id was not found,
+// PutValue creates a new session and returns the new session id.
+func (st *FileStore) PutValue(sid string, key string, value interface{}) string {
+	defer st.lock(true)()
+	rec := st.load(sid)
+	if rec == nil {
+		sid = newSessionID()
+		rec = &fileRecord{
+			Ctime:  time.Now(),
+			Values: make(map[string]interface{}),
+		}
+	}
+	rec.Values[key] = value
+	st.write(sid, rec)
+	return sid
+}
+
+// GetValue returns a session value. If the session or the key does not
+// exist, it returns nil.
+func (st *FileStore) GetValue(sid string, key string) interface{} {
+	defer st.lock(false)()
+	rec := st.load(sid)
+	if rec == nil {
+		return nil
+	}
+	return rec.Values[key]
+}
+
+// DeleteValue removes a value from a session. It does nothing if the
+// session or the key does not exist.
+func (st *FileStore) DeleteValue(sid string, key string) {
+	defer st.lock(true)()
+	rec := st.load(sid)
+	if rec == nil {
+		return
+	}
+	if _, ok := rec.Values[key]; ok {
+		delete(rec.Values, key)
+		st.write(sid, rec)
+	}
+}
+
+// GetKeys returns the sorted keys of a session, or nil if the session
+// does not exist.
+func (st *FileStore) GetKeys(sid string) []string {
+	defer st.lock(false)()
+	rec := st.load(sid)
+	if rec == nil {
+		return nil
+	}
+	return sortedKeys(rec.Values)
+}
+
+// GetSessionInfos returns map of maps containg all sessions with
+// their key/value pairs. Files that cannot be read are skipped.
+func (st *FileStore) GetSessionInfos() map[string]map[string]interface{} {
+	defer st.lock(false)()
+	infos := make(map[string]map[string]interface{})
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		return infos
+	}
+	for _, entry := range entries {
+		sid, ok := strings.CutSuffix(entry.Name(), fileSuffix)
+		if !ok || st.path(sid) == "" {
+			continue
+		}
+		rec, atime, err := st.read(filepath.Join(st.dir, entry.Name()))
+		if err != nil || rec == nil {
+			continue
+		}
+		infos[sid] = make(map[string]interface{})
+		infos[sid]["_sid"] = sid
+		infos[sid]["_ctime"] = rec.Ctime.String()
+		infos[sid]["_atime"] = atime.String()
+		infos[sid]["_expires"] = st.expiry(rec, atime).String()
+		for key := range rec.Values {
+			infos[sid][key] = rec.Values[key]
+		}
+	}
+	return infos
+}
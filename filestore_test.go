@@ -0,0 +1,173 @@
+package wuppo
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type fileStoreUser struct {
+	Name  string
+	Admin bool
+}
+
+func init() {
+	gob.Register(fileStoreUser{})
+}
+
+func TestFileStore(t *testing.T) {
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		dir := t.TempDir()
+		store, err := NewFileStore(dir, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sid := store.PutValue("../../etc/passwd", "name", "chris")
+		if len(sid) != 32 {
+			t.Fatalf("wanted new session id but was %q", sid)
+		}
+		if store.PutValue(sid, "count", 2) != sid {
+			t.Errorf("wanted same session id")
+		}
+		store.Close()
+		// sessions survive a restart
+		store, err = NewFileStore(dir, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		if v := store.GetValue(sid, "name"); v != "chris" {
+			t.Errorf("wanted chris but was %v", v)
+		}
+		if v := store.GetValue(sid, "count"); v != 2 && v != 2.0 {
+			t.Errorf("wanted 2 but was %v", v)
+		}
+		if len(store.GetSessionInfos()) != 1 {
+			t.Errorf("wanted 1 session info")
+		}
+		// expire by modification time
+		old := time.Now().Add(-31 * time.Minute)
+		if err := os.Chtimes(filepath.Join(dir, sid+".session"), old, old); err != nil {
+			t.Fatal(err)
+		}
+		if store.GetValue(sid, "name") != nil {
+			t.Errorf("wanted expired session")
+		}
+		tmp := filepath.Join(dir, sid+".123.tmp")
+		os.WriteFile(tmp, nil, 0600)
+		os.Chtimes(tmp, old, old)
+		store.ExpireSessions()
+		files, _ := filepath.Glob(filepath.Join(dir, "[^.]*"))
+		if len(files) != 0 {
+			t.Errorf("wanted no files but was %v", files)
+		}
+		// persistent sessions
+		sid = store.PutValue("", "name", "chris")
+		store.SetSessionLifetime(sid, 24*time.Hour, 0)
+		expiry, persistent := store.SessionExpiry(sid)
+		if !persistent || expiry.Before(time.Now().Add(23*time.Hour)) {
+			t.Errorf("wanted persistent session but was %v %v", expiry, persistent)
+		}
+		newSid := store.RenameSession(sid)
+		if store.GetValue(sid, "name") != nil || store.GetValue(newSid, "name") != "chris" {
+			t.Errorf("wanted renamed session")
+		}
+		sid = newSid
+		store.KillSession(sid)
+		if store.GetValue(sid, "name") != nil {
+			t.Errorf("wanted killed session")
+		}
+	}
+}
+
+func TestFileStoreGob(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	sid := store.PutValue("", "user", fileStoreUser{"chris", true})
+	user, ok := store.GetValue(sid, "user").(fileStoreUser)
+	if !ok || user.Name != "chris" || !user.Admin {
+		t.Errorf("wrong user %v", store.GetValue(sid, "user"))
+	}
+}
+
+func TestFileStoreCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	corrupt := func() (string, string) {
+		sid := newSessionID()
+		path := filepath.Join(dir, sid+".session")
+		if err := os.WriteFile(path, []byte("not gob"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return sid, path
+	}
+	// requests treat a corrupt session as missing
+	sid, path := corrupt()
+	if store.GetValue(sid, "name") != nil {
+		t.Errorf("wanted no value")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("wanted corrupt file to be removed")
+	}
+	if newSid := store.PutValue(sid, "name", "chris"); newSid == sid {
+		t.Errorf("wanted new session id")
+	}
+	// the janitor removes old corrupt files, and reads recent files only
+	_, path = corrupt()
+	_, recent := corrupt()
+	old := time.Now().Add(-31 * time.Minute)
+	os.Chtimes(path, old, old)
+	store.ExpireSessions()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("wanted old corrupt file to be removed")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("wanted recent file to be kept, it was not read")
+	}
+}
+
+func TestFileStoreSharedLock(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("no file locks")
+	}
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	other, err := NewFileStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	unlock1 := store.lock(false)
+	unlock2 := store.lock(false)
+	locked := make(chan struct{})
+	go func() {
+		other.lock(true)()
+		close(locked)
+	}()
+	unlock1()
+	select {
+	case <-locked:
+		t.Fatalf("wanted the file lock to be held by the second reader")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock2()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("wanted the file lock to be released by the last reader")
+	}
+}
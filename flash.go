@@ -0,0 +1,43 @@
+package wuppo
+
+import (
+	"encoding/gob"
+)
+
+// A Flash is a one-shot message, like "Your profile was saved", that is
+// stored in the session until it is read, so it survives a redirect.
+type Flash struct {
+	Kind    string // for instance "info" or "error"
+	Message string
+}
+
+// flashKey is the session key of the flashes.
+const flashKey = "_flashes"
+
+// flashModelKey is the model key of the flashes of a template response.
+const flashModelKey = "flashes"
+
+func init() {
+	// stores that encode sessions with gob must know the flash type
+	gob.Register([]Flash{})
+}
+
+// toFlashes converts a session value to flashes. Stores that encode
+// sessions as JSON return flashes as generic maps.
+func toFlashes(v interface{}) []Flash {
+	switch v := v.(type) {
+	case []Flash:
+		return v
+	case []interface{}:
+		var flashes []Flash
+		for _, item := range v {
+			if m, ok := item.(map[string]interface{}); ok {
+				kind, _ := m["Kind"].(string)
+				message, _ := m["Message"].(string)
+				flashes = append(flashes, Flash{kind, message})
+			}
+		}
+		return flashes
+	}
+	return nil
+}
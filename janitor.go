@@ -0,0 +1,64 @@
+package wuppo
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultJanitorInterval is the interval in which the session janitor of a
+// Handler expires old sessions.
+const DefaultJanitorInterval = time.Minute
+
+// janitor is a goroutine that expires old sessions in the background, so
+// that request handling never waits for it.
+type janitor struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// selfExpiringStore is implemented by session stores whose sessions
+// expire without ExpireSessions, so a Handler starts no janitor for them.
+type selfExpiringStore interface {
+	selfExpiring()
+}
+
+// startJanitor starts a janitor that calls store.ExpireSessions every
+// interval.
+func startJanitor(store SessionStore, interval time.Duration) *janitor {
+	j := &janitor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				store.ExpireSessions()
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+	return j
+}
+
+// close stops the janitor and waits until it has stopped.
+func (j *janitor) close() {
+	j.once.Do(func() {
+		close(j.stop)
+	})
+	<-j.done
+}
+
+// Close stops the background session janitor of the Handler. It does not
+// close the session store. Close is safe to call more than once.
+func (handler *Handler) Close() error {
+	if handler.janitor != nil {
+		handler.janitor.close()
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package wuppo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// JSONOptions controls how Req.BindJSON decodes request bodies.
+type JSONOptions struct {
+	// MaxBytes limits the size of the request body. Larger bodies are
+	// rejected with an error. Zero or less means no limit.
+	MaxBytes int64
+
+	// DisallowUnknownFields rejects bodies with object keys that do not
+	// match a field of the destination struct.
+	DisallowUnknownFields bool
+}
+
+// DefaultJSONOptions are the JSONOptions of a new Handler: bodies are
+// limited to 1 MB and unknown fields are ignored.
+var DefaultJSONOptions = JSONOptions{
+	MaxBytes: 1 << 20,
+}
+
+// decodeJSON decodes exactly one JSON value from r into v.
+func decodeJSON(r io.Reader, v interface{}, opts JSONOptions) error {
+	dec := json.NewDecoder(r)
+	if opts.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			return errors.New("wuppo: empty JSON body")
+		}
+		return fmt.Errorf("wuppo: cannot decode JSON body: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("wuppo: JSON body must contain a single value")
+	}
+	return nil
+}
+
+// checkJSONContentType returns an error if contentType is set but is not
+// a JSON media type.
+func checkJSONContentType(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("wuppo: invalid Content-Type %q: %w", contentType, err)
+	}
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return fmt.Errorf("wuppo: Content-Type %q is not application/json", contentType)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package wuppo
+
+import (
+	"net/http"
+)
+
+// Middleware wraps a ServeFunc. A Middleware may do work before and after
+// calling next, or it may short-circuit the request by setting a response
+// on the Req and not calling next at all:
+//
+//	func requireLogin(next wuppo.ServeFunc) wuppo.ServeFunc {
+//		return func(req wuppo.Req) {
+//			if req.SessionValue("user") == nil {
+//				req.SetRedirect("/login")
+//				return
+//			}
+//			next(req)
+//		}
+//	}
+type Middleware func(next ServeFunc) ServeFunc
+
+// HTTPMiddleware wraps the net/http/Handler that creates the Req, calls the
+// ServeFunc and writes the response. Use it for work that needs the raw
+// http.ResponseWriter or that must include response rendering, like
+// access logging.
+type HTTPMiddleware func(next http.Handler) http.Handler
+
+// Chain wraps serve with middlewares. The first middleware is the
+// outermost one, so it runs first before and last after serve.
+func Chain(serve ServeFunc, middlewares ...Middleware) ServeFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		serve = middlewares[i](serve)
+	}
+	return serve
+}
+
+// ChainHTTP wraps h with middlewares. The first middleware is the
+// outermost one, so it runs first before and last after h.
+func ChainHTTP(h http.Handler, middlewares ...HTTPMiddleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// ExpireSessions returns a HTTPMiddleware that expires old sessions in
+// store before each request. A Handler created by New expires sessions in
+// the background instead, so this is only needed if the janitor was
+// disabled with WithJanitorInterval.
+func ExpireSessions(store SessionStore) HTTPMiddleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			store.ExpireSessions()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
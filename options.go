@@ -0,0 +1,345 @@
+package wuppo
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// An Option configures a Handler created by New.
+type Option func(c *config)
+
+// config collects the settings of the Options passed to New.
+type config struct {
+	store              SessionStore
+	fsys               fs.FS
+	patterns           []string
+	funcmap            template.FuncMap
+	logger             *slog.Logger
+	errorPages         map[int]errorPage
+	cookie             CookieConfig
+	rotateKeys         map[string]bool
+	csrf               *csrf
+	trustedProxies     []netip.Prefix
+	forwardedHeader    string
+	sessionTTL         time.Duration
+	sessionMaxLifetime time.Duration
+	janitorInterval    time.Duration
+	defaultMiddlewares bool
+	middlewares        []Middleware
+	httpMiddlewares    []HTTPMiddleware
+	dev                bool
+	defaultLayout      string
+	jsonOptions        JSONOptions
+	err                error
+}
+
+// New creates a new Handler with a ServeFunc and options. Without options,
+// the Handler stores sessions in a new MemStore, loads templates from
+// "*.html" in the current directory, logs to slog.Default() and has the
+// default middleware AccessLog installed. A background janitor expires
+// old sessions every DefaultJanitorInterval, unless the store expires
+// them itself; call Close to stop it:
+//
+//	handler, err := wuppo.New(router.Serve,
+//		wuppo.WithTemplates(files, "templates/*.html"),
+//		wuppo.WithDefaultLayout("layout.html"),
+//		wuppo.WithSessionTTL(2*time.Hour),
+//		wuppo.WithMiddleware(requireLogin),
+//	)
+//
+// New returns an error if the templates cannot be parsed, or if an option
+// is not supported.
+func New(serve ServeFunc, opts ...Option) (*Handler, error) {
+	c := &config{
+		fsys:               os.DirFS("."),
+		patterns:           []string{"*.html"},
+		errorPages:         make(map[int]errorPage),
+		rotateKeys:         make(map[string]bool),
+		defaultMiddlewares: true,
+		janitorInterval:    DefaultJanitorInterval,
+		jsonOptions:        DefaultJSONOptions,
+		forwardedHeader:    DefaultForwardedHeader,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.store == nil {
+		c.store = NewMemStore()
+	}
+	if c.logger == nil {
+		c.logger = slog.Default()
+	}
+	if c.sessionTTL > 0 {
+		st, ok := c.store.(interface{ SetIdleTimeout(time.Duration) })
+		if !ok {
+			return nil, fmt.Errorf("wuppo: session store %T does not support a session TTL", c.store)
+		}
+		st.SetIdleTimeout(c.sessionTTL)
+	}
+	if c.sessionMaxLifetime > 0 {
+		st, ok := c.store.(interface{ SetMaxLifetime(time.Duration) })
+		if !ok {
+			return nil, fmt.Errorf("wuppo: session store %T does not support a session max lifetime", c.store)
+		}
+		st.SetMaxLifetime(c.sessionMaxLifetime)
+	}
+	funcmap := c.funcmap
+	if c.csrf != nil {
+		funcmap = c.csrf.funcs(funcmap)
+	}
+	templates, err := newTemplateCache(c.fsys, c.patterns, funcmap)
+	if err != nil {
+		return nil, err
+	}
+	templates.setDev(c.dev)
+	h := &Handler{
+		serve:           serve,
+		store:           c.store,
+		templates:       templates,
+		logger:          c.logger,
+		cookie:          c.cookie.withDefaults(),
+		rotateKeys:      c.rotateKeys,
+		csrf:            c.csrf,
+		trustedProxies:  c.trustedProxies,
+		forwardedHeader: c.forwardedHeader,
+		middlewares:     c.middlewares,
+		jsonOptions:     c.jsonOptions,
+		errorPages:      c.errorPages,
+		defaultLayout:   c.defaultLayout,
+		dev:             c.dev,
+	}
+	if c.defaultMiddlewares {
+		h.httpMiddlewares = []HTTPMiddleware{AccessLog(c.logger)}
+	}
+	h.httpMiddlewares = append(h.httpMiddlewares, c.httpMiddlewares...)
+	if _, ok := c.store.(selfExpiringStore); !ok && c.janitorInterval > 0 {
+		h.janitor = startJanitor(c.store, c.janitorInterval)
+	}
+	return h, nil
+}
+
+// WithSessionStore sets the SessionStore. The default is a new MemStore.
+func WithSessionStore(store SessionStore) Option {
+	return func(c *config) {
+		c.store = store
+	}
+}
+
+// WithTemplates loads the templates in fsys that match one of the
+// patterns. See Handler.SetTemplateFS.
+func WithTemplates(fsys fs.FS, patterns ...string) Option {
+	return func(c *config) {
+		c.fsys = fsys
+		c.patterns = patterns
+	}
+}
+
+// WithTemplatePattern loads the templates that match a file system glob
+// pattern, relative to the current directory. An empty pattern loads no
+// templates. The default is "*.html".
+func WithTemplatePattern(pattern string) Option {
+	return func(c *config) {
+		c.fsys = os.DirFS(".")
+		c.patterns = nil
+		if pattern != "" {
+			dir, p := splitGlob(pattern)
+			c.fsys = os.DirFS(dir)
+			c.patterns = []string{p}
+		}
+	}
+}
+
+// WithFuncMap sets the functions that are available in templates.
+func WithFuncMap(funcmap template.FuncMap) Option {
+	return func(c *config) {
+		c.funcmap = funcmap
+	}
+}
+
+// WithLogger sets the logger for access logs, panics and rendering errors.
+// The default is slog.Default(). To silence the Handler, pass a logger
+// with a handler that discards all records, like slog.DiscardHandler.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// WithErrorTemplate sets the template that renders the response for a
+// status code. See Handler.SetErrorTemplate.
+func WithErrorTemplate(code int, template string) Option {
+	return func(c *config) {
+		c.errorPages[code] = errorPage{template: template}
+	}
+}
+
+// WithErrorServe sets the ServeFunc that renders the response for a status
+// code. See Handler.SetErrorServe.
+func WithErrorServe(code int, serve ServeFunc) Option {
+	return func(c *config) {
+		c.errorPages[code] = errorPage{serve: serve}
+	}
+}
+
+// WithCookieName sets the name of the session cookie. The default is
+// DefaultCookieName.
+func WithCookieName(name string) Option {
+	return func(c *config) {
+		c.cookie.Name = name
+	}
+}
+
+// WithCookieConfig sets the attributes of the session cookie, see
+// CookieConfig. Zero fields keep their defaults, for instance:
+//
+//	wuppo.WithCookieConfig(wuppo.CookieConfig{
+//		Domain:   "example.com",
+//		SameSite: http.SameSiteStrictMode,
+//	}),
+func WithCookieConfig(cfg CookieConfig) Option {
+	return func(c *config) {
+		c.cookie = cfg
+	}
+}
+
+// WithSessionRotation regenerates the session, see Req.RegenerateSession,
+// before a request sets one of the session values keys for the first time
+// in that request. Pass the keys that change the privileges of a session,
+// for instance the key of the logged in user:
+//
+//	wuppo.WithSessionRotation("user", "role"),
+func WithSessionRotation(keys ...string) Option {
+	return func(c *config) {
+		for _, key := range keys {
+			c.rotateKeys[key] = true
+		}
+	}
+}
+
+// WithCSRF turns on the protection against cross-site request forgery,
+// see CSRFConfig. Requests that fail the check get the error page for
+// status 403, which WithErrorTemplate and WithErrorServe configure:
+//
+//	wuppo.WithCSRF(wuppo.CSRFConfig{Exempt: []string{"/api/"}}),
+//	wuppo.WithErrorTemplate(http.StatusForbidden, "forbidden.html"),
+func WithCSRF(cfg CSRFConfig) Option {
+	return func(c *config) {
+		c.csrf = newCSRF(cfg)
+	}
+}
+
+// WithTrustedProxies sets the IP addresses and CIDR ranges of the reverse
+// proxies in front of the Handler, like "127.0.0.1" or "10.0.0.0/8".
+// Req.ClientIP takes the client address from the forwarded header of
+// requests from these proxies only, since clients can send that header
+// too. The same holds for the protocol that CookieSecureAuto checks. The
+// default is no trusted proxies. New returns an error if an
+// address cannot be parsed. See WithForwardedHeader.
+func WithTrustedProxies(proxies ...string) Option {
+	return func(c *config) {
+		prefixes, err := parseTrustedProxies(proxies)
+		if err != nil {
+			c.err = fmt.Errorf("wuppo: invalid trusted proxy: %w", err)
+			return
+		}
+		c.trustedProxies = append(c.trustedProxies, prefixes...)
+	}
+}
+
+// WithForwardedHeader sets the request header in which the trusted proxies
+// send the client address, either "Forwarded" (RFC 7239), or a header with
+// a comma separated list of addresses, like "X-Forwarded-For" or
+// "X-Real-IP". Set it to the header that the proxies set: other
+// forwarding headers are ignored, since the proxies pass them on from the
+// client unchanged. The default is DefaultForwardedHeader.
+func WithForwardedHeader(header string) Option {
+	return func(c *config) {
+		c.forwardedHeader = header
+	}
+}
+
+// WithSessionTTL sets the time after which a session expires if it is not
+// accessed. The session store must have a SetIdleTimeout method, like
+// MemStore has. The default is the TTL of the store.
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.sessionTTL = ttl
+	}
+}
+
+// WithSessionMaxLifetime sets the time after which a session expires, no
+// matter how often it is accessed. The session store must have a
+// SetMaxLifetime method, like MemStore has. The default is the maximum
+// lifetime of the store.
+func WithSessionMaxLifetime(d time.Duration) Option {
+	return func(c *config) {
+		c.sessionMaxLifetime = d
+	}
+}
+
+// WithJanitorInterval sets the interval in which the background janitor
+// expires old sessions. Zero or less disables the janitor. The default is
+// DefaultJanitorInterval. Stores that expire sessions themselves, like
+// CookieStore and RedisStore, never need a janitor.
+func WithJanitorInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.janitorInterval = interval
+	}
+}
+
+// WithMiddleware appends middlewares that wrap the ServeFunc.
+// See Handler.Use.
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(c *config) {
+		c.middlewares = append(c.middlewares, middlewares...)
+	}
+}
+
+// WithHTTPMiddleware appends middlewares that wrap the whole request
+// processing. They run after the default middlewares. See Handler.UseHTTP.
+func WithHTTPMiddleware(middlewares ...HTTPMiddleware) Option {
+	return func(c *config) {
+		c.httpMiddlewares = append(c.httpMiddlewares, middlewares...)
+	}
+}
+
+// WithoutDefaultMiddleware removes the default middleware AccessLog. Use
+// it together with WithHTTPMiddleware to log requests in another format:
+//
+//	wuppo.WithoutDefaultMiddleware(),
+//	wuppo.WithHTTPMiddleware(wuppo.AccessLogFormat(os.Stdout, wuppo.LogFormatCombined)),
+func WithoutDefaultMiddleware() Option {
+	return func(c *config) {
+		c.defaultMiddlewares = false
+	}
+}
+
+// WithDevMode turns development mode on or off. See Handler.SetDevMode.
+func WithDevMode(dev bool) Option {
+	return func(c *config) {
+		c.dev = dev
+	}
+}
+
+// WithDefaultLayout sets the default layout. See Handler.SetDefaultLayout.
+func WithDefaultLayout(layout string) Option {
+	return func(c *config) {
+		c.defaultLayout = layout
+	}
+}
+
+// WithJSONOptions sets the options for Req.BindJSON. The default is
+// DefaultJSONOptions.
+func WithJSONOptions(opts JSONOptions) Option {
+	return func(c *config) {
+		c.jsonOptions = opts
+	}
+}
@@ -0,0 +1,464 @@
+package wuppo
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisStore is a SessionStore that stores HTTP sessions in a Redis
+// compatible server, so several instances of an application behind a load
+// balancer share their sessions. It speaks the RESP protocol over TCP.
+//
+// Each session is a Redis hash with the key prefix plus the session id.
+// Session values are encoded with a Codec, with GobCodec their types must
+// be registered with gob.Register (see GobCodec). Redis expires sessions
+// with TTLs that are renewed when a session is touched, so ExpireSessions
+// does nothing and the janitor is not needed.
+//
+// Connections are kept in a pool. Since SessionStore methods cannot
+// return errors, they panic if the server cannot be reached or does not
+// answer within the timeout, which the Handler turns into a 500 response.
+type RedisStore struct {
+	addr        string
+	codec       Codec
+	prefix      string
+	password    string
+	timeout     time.Duration
+	mx          sync.Mutex
+	idle        []*respConn
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+}
+
+// maxIdleConns is the maximum number of idle connections in the pool of a
+// RedisStore.
+const maxIdleConns = 16
+
+// NewRedisStore creates a new RedisStore for the server at addr, for
+// instance "localhost:6379". Values are encoded with codec, if codec is
+// nil, it uses GobCodec. The key prefix is "wuppo:session:". Connections
+// are opened when they are needed, use Ping to check the server.
+func NewRedisStore(addr string, codec Codec) *RedisStore {
+	if codec == nil {
+		codec = GobCodec
+	}
+	st := &RedisStore{
+		addr:        addr,
+		codec:       codec,
+		prefix:      "wuppo:session:",
+		timeout:     5 * time.Second,
+		idleTimeout: 30 * time.Minute,
+	}
+	return st
+}
+
+// Ping returns an error if the server cannot be reached.
+func (st *RedisStore) Ping() error {
+	_, err := st.do([]string{"PING"})
+	return err
+}
+
+// SetKeyPrefix sets the prefix of the keys of sessions. The default is
+// "wuppo:session:".
+func (st *RedisStore) SetKeyPrefix(prefix string) {
+	st.prefix = prefix
+}
+
+// SetPassword sets the password that new connections send with the AUTH
+// command. The default is no password.
+func (st *RedisStore) SetPassword(password string) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.password = password
+	for _, c := range st.idle {
+		c.conn.Close()
+	}
+	st.idle = nil
+}
+
+// SetTimeout sets the time that connecting to the server, and each round
+// trip of commands, may take. Sessions are touched with every request, so
+// without a timeout, a server that hangs would block all requests. The
+// default is 5 seconds. Zero or less means no timeout.
+func (st *RedisStore) SetTimeout(d time.Duration) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.timeout = d
+}
+
+// setDeadline sets the deadline of a connection for the next round trip.
+func setDeadline(c *respConn, timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	c.conn.SetDeadline(deadline)
+}
+
+// Close closes the idle connections of the store.
+func (st *RedisStore) Close() error {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	for _, c := range st.idle {
+		c.conn.Close()
+	}
+	st.idle = nil
+	return nil
+}
+
+// SetIdleTimeout sets the time after which a session expires if it is not
+// accessed. The default is 30 minutes.
+func (st *RedisStore) SetIdleTimeout(d time.Duration) {
+	st.idleTimeout = d
+}
+
+// SetMaxLifetime sets the time after which a session expires, no matter
+// how often it is accessed. The default is 0, which means no maximum.
+func (st *RedisStore) SetMaxLifetime(d time.Duration) {
+	st.maxLifetime = d
+}
+
+// conn returns an idle connection, or a new one, and the timeout of the
+// store.
+func (st *RedisStore) conn() (*respConn, time.Duration, error) {
+	st.mx.Lock()
+	timeout := st.timeout
+	if n := len(st.idle); n > 0 {
+		c := st.idle[n-1]
+		st.idle = st.idle[:n-1]
+		st.mx.Unlock()
+		return c, timeout, nil
+	}
+	password := st.password
+	st.mx.Unlock()
+	dialer := net.Dialer{}
+	if timeout > 0 {
+		dialer.Timeout = timeout
+	}
+	conn, err := dialer.Dial("tcp", st.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	c := newRespConn(conn)
+	if password != "" {
+		setDeadline(c, timeout)
+		replies, err := c.do([]string{"AUTH", password})
+		if err == nil {
+			if e, ok := replies[0].(respError); ok {
+				err = e
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+	}
+	return c, timeout, nil
+}
+
+// do sends commands in a pipeline and returns their replies. It returns
+// the first error reply as error.
+func (st *RedisStore) do(cmds ...[]string) ([]interface{}, error) {
+	c, timeout, err := st.conn()
+	if err != nil {
+		return nil, err
+	}
+	setDeadline(c, timeout)
+	replies, err := c.do(cmds...)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	st.mx.Lock()
+	if len(st.idle) < maxIdleConns {
+		st.idle = append(st.idle, c)
+	} else {
+		c.conn.Close()
+	}
+	st.mx.Unlock()
+	for _, reply := range replies {
+		if err, ok := reply.(respError); ok {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// mustDo is like do but panics on errors.
+func (st *RedisStore) mustDo(cmds ...[]string) []interface{} {
+	replies, err := st.do(cmds...)
+	if err != nil {
+		panic(err)
+	}
+	return replies
+}
+
+// redisMeta holds the fields of a session hash that are not values.
+type redisMeta struct {
+	ctime       time.Time
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	persistent  bool
+}
+
+// metaFields are the fields of a session hash that hold a redisMeta.
+var metaFields = []string{"_ctime", "_idle", "_max", "_persistent"}
+
+// parseMeta parses the reply of HMGET for the metaFields. It returns nil
+// if the session does not exist.
+func parseMeta(reply interface{}) *redisMeta {
+	fields, _ := reply.([]interface{})
+	if len(fields) != len(metaFields) || fields[0] == nil {
+		return nil
+	}
+	parse := func(v interface{}) int64 {
+		s, _ := v.(string)
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return n
+	}
+	return &redisMeta{
+		ctime:       time.Unix(0, parse(fields[0])),
+		idleTimeout: time.Duration(parse(fields[1])),
+		maxLifetime: time.Duration(parse(fields[2])),
+		persistent:  parse(fields[3]) == 1,
+	}
+}
+
+// key returns the key of a session.
+func (st *RedisStore) key(sid string) string {
+	return st.prefix + sid
+}
+
+// getMeta returns the meta data of a session, or nil if the session does
+// not exist.
+func (st *RedisStore) getMeta(sid string) *redisMeta {
+	args := append([]string{"HMGET", st.key(sid)}, metaFields...)
+	return parseMeta(st.mustDo(args)[0])
+}
+
+// ttl returns the time until a session that is accessed now expires.
+func (st *RedisStore) ttl(m *redisMeta) time.Duration {
+	return time.Until(expiryOf(m.ctime, time.Now(), st.idleTimeout, st.maxLifetime, m.idleTimeout, m.maxLifetime))
+}
+
+// expire sets the TTL of a session that is accessed now, or deletes it if
+// it has expired.
+func (st *RedisStore) expire(sid string, m *redisMeta) []string {
+	ttl := st.ttl(m)
+	if ttl <= 0 {
+		return []string{"DEL", st.key(sid)}
+	}
+	return []string{"PEXPIRE", st.key(sid), strconv.FormatInt(ttl.Milliseconds()+1, 10)}
+}
+
+// SetSessionLifetime overrides the idle timeout and the maximum lifetime
+// of a session. A zero duration keeps the default of the store.
+func (st *RedisStore) SetSessionLifetime(sid string, idleTimeout time.Duration, maxLifetime time.Duration) {
+	m := st.getMeta(sid)
+	if m == nil {
+		return
+	}
+	m.idleTimeout = idleTimeout
+	m.maxLifetime = maxLifetime
+	m.persistent = true
+	st.mustDo(
+		[]string{"HSET", st.key(sid),
+			"_idle", strconv.FormatInt(int64(idleTimeout), 10),
+			"_max", strconv.FormatInt(int64(maxLifetime), 10),
+			"_persistent", "1"},
+		st.expire(sid, m),
+	)
+}
+
+// SessionExpiry returns the time at which a session expires if it is not
+// accessed before, and whether the session is persistent. If the session
+// does not exist, it returns the zero time.
+func (st *RedisStore) SessionExpiry(sid string) (time.Time, bool) {
+	args := append([]string{"HMGET", st.key(sid)}, metaFields...)
+	replies := st.mustDo(args, []string{"PTTL", st.key(sid)})
+	m := parseMeta(replies[0])
+	pttl, _ := replies[1].(int64)
+	if m == nil || pttl < 0 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(time.Duration(pttl) * time.Millisecond), m.persistent
+}
+
+// ExpireSessions does nothing, since Redis expires sessions with TTLs.
+func (st *RedisStore) ExpireSessions() {}
+
+// selfExpiring tells the Handler that it needs no janitor for this store.
+func (st *RedisStore) selfExpiring() {}
+
+// TouchSession renews the TTL of a session.
+func (st *RedisStore) TouchSession(sid string) {
+	st.TouchSessionExpiry(sid)
+}
+
+// TouchSessionExpiry renews the TTL of a session and returns its new
+// expiry, and whether it is persistent. If the session does not exist, it
+// returns the zero time.
+func (st *RedisStore) TouchSessionExpiry(sid string) (time.Time, bool) {
+	m := st.getMeta(sid)
+	if m == nil {
+		return time.Time{}, false
+	}
+	ttl := st.ttl(m)
+	st.mustDo(st.expire(sid, m))
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(ttl), m.persistent
+}
+
+// RenameSession moves the data of a session to a new random session id
+// with the RENAME command, which keeps the TTL. It returns the new id, or
+// the empty string if the session does not exist.
+func (st *RedisStore) RenameSession(sid string) string {
+	if st.getMeta(sid) == nil {
+		return ""
+	}
+	newSid := newSessionID()
+	if _, err := st.do([]string{"RENAME", st.key(sid), st.key(newSid)}); err != nil {
+		if _, ok := err.(respError); ok {
+			// the session expired in between
+			return ""
+		}
+		panic(err)
+	}
+	return newSid
+}
+
+// KillSession removes a session.
+func (st *RedisStore) KillSession(sid string) {
+	st.mustDo([]string{"DEL", st.key(sid)})
+}
+
+// PutValue puts a value into a session and returns the session id.
+// If the session with the incoming session id was not found,
+// PutValue creates a new session and returns the new session id.
+func (st *RedisStore) PutValue(sid string, key string, value interface{}) string {
+	data, err := encodeValue(st.codec, value)
+	if err != nil {
+		panic(err)
+	}
+	if st.getMeta(sid) != nil {
+		replies := st.mustDo(
+			[]string{"HSET", st.key(sid), "v:" + key, string(data)},
+			[]string{"PTTL", st.key(sid)},
+		)
+		if pttl, _ := replies[1].(int64); pttl >= 0 {
+			return sid
+		}
+		// the session expired before HSET, which created a key without TTL
+		st.mustDo([]string{"DEL", st.key(sid)})
+	}
+	sid = newSessionID()
+	m := &redisMeta{ctime: time.Now()}
+	st.mustDo(
+		[]string{"HSET", st.key(sid),
+			"_ctime", strconv.FormatInt(m.ctime.UnixNano(), 10),
+			"_idle", "0", "_max", "0", "_persistent", "0",
+			"v:" + key, string(data)},
+		st.expire(sid, m),
+	)
+	return sid
+}
+
+// GetValue returns a session value. If the session or the key does not
+// exist, it returns nil. A value that cannot be decoded is removed and
+// treated as missing.
+func (st *RedisStore) GetValue(sid string, key string) interface{} {
+	data, ok := st.mustDo([]string{"HGET", st.key(sid), "v:" + key})[0].(string)
+	if !ok {
+		return nil
+	}
+	value, err := decodeValue(st.codec, []byte(data))
+	if err != nil {
+		// a value of an old codec or type fails every request that reads
+		// it, so it is dropped like a missing value
+		st.mustDo([]string{"HDEL", st.key(sid), "v:" + key})
+		return nil
+	}
+	return value
+}
+
+// DeleteValue removes a value from a session. It does nothing if the
+// session or the key does not exist.
+func (st *RedisStore) DeleteValue(sid string, key string) {
+	st.mustDo([]string{"HDEL", st.key(sid), "v:" + key})
+}
+
+// GetKeys returns the sorted keys of a session, or nil if the session
+// does not exist.
+func (st *RedisStore) GetKeys(sid string) []string {
+	fields, _ := st.mustDo([]string{"HKEYS", st.key(sid)})[0].([]interface{})
+	if len(fields) == 0 {
+		return nil
+	}
+	keys := []string{}
+	for _, field := range fields {
+		name, _ := field.(string)
+		if key, ok := strings.CutPrefix(name, "v:"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GetSessionInfos returns map of maps containg all sessions with
+// their key/value pairs. It scans all keys with the key prefix, so it
+// should not be used with many sessions. Values that cannot be decoded
+// are skipped.
+func (st *RedisStore) GetSessionInfos() map[string]map[string]interface{} {
+	infos := make(map[string]map[string]interface{})
+	cursor := "0"
+	for {
+		reply := st.mustDo([]string{"SCAN", cursor, "MATCH", st.prefix + "*", "COUNT", "100"})[0]
+		array, _ := reply.([]interface{})
+		if len(array) != 2 {
+			panic(fmt.Errorf("wuppo: redis: invalid SCAN reply %v", reply))
+		}
+		cursor, _ = array[0].(string)
+		keys, _ := array[1].([]interface{})
+		for _, k := range keys {
+			key, _ := k.(string)
+			st.addSessionInfo(infos, strings.TrimPrefix(key, st.prefix))
+		}
+		if cursor == "0" {
+			return infos
+		}
+	}
+}
+
+// addSessionInfo adds the info of a session to infos.
+func (st *RedisStore) addSessionInfo(infos map[string]map[string]interface{}, sid string) {
+	replies := st.mustDo([]string{"HGETALL", st.key(sid)}, []string{"PTTL", st.key(sid)})
+	fields, _ := replies[0].([]interface{})
+	pttl, _ := replies[1].(int64)
+	if len(fields) == 0 || pttl < 0 {
+		return
+	}
+	info := make(map[string]interface{})
+	info["_sid"] = sid
+	info["_expires"] = time.Now().Add(time.Duration(pttl) * time.Millisecond).String()
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		data, _ := fields[i+1].(string)
+		if name == "_ctime" {
+			n, _ := strconv.ParseInt(data, 10, 64)
+			info["_ctime"] = time.Unix(0, n).String()
+		} else if key, ok := strings.CutPrefix(name, "v:"); ok {
+			if value, err := decodeValue(st.codec, []byte(data)); err == nil {
+				info[key] = value
+			}
+		}
+	}
+	infos[sid] = info
+}
@@ -0,0 +1,286 @@
+package wuppo
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respServer is a tiny in-process server that speaks enough RESP to test
+// RedisStore: PING, AUTH, RENAME, DEL, PEXPIRE, PTTL, SCAN and the hash
+// commands.
+type respServer struct {
+	ln       net.Listener
+	password string
+	mx       sync.Mutex
+	hashes   map[string]map[string]string
+	expires  map[string]time.Time
+}
+
+func newRespServer(t *testing.T, password string) *respServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &respServer{
+		ln:       ln,
+		password: password,
+		hashes:   make(map[string]map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *respServer) addr() string {
+	return srv.ln.Addr().String()
+}
+
+func (srv *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authed := srv.password == ""
+	for {
+		cmd, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range cmd.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		if args[0] == "AUTH" {
+			authed = args[1] == srv.password
+		}
+		if !authed {
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		} else {
+			srv.mx.Lock()
+			srv.exec(w, args)
+			srv.mx.Unlock()
+		}
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+	}
+}
+
+// hash returns a hash that has not expired, or nil.
+func (srv *respServer) hash(key string) map[string]string {
+	if exp, ok := srv.expires[key]; ok && time.Now().After(exp) {
+		delete(srv.hashes, key)
+		delete(srv.expires, key)
+	}
+	return srv.hashes[key]
+}
+
+func (srv *respServer) exec(w *bufio.Writer, args []string) {
+	bulk := func(s string, ok bool) {
+		if ok {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	}
+	switch args[0] {
+	case "PING", "AUTH":
+		w.WriteString("+OK\r\n")
+	case "HSET":
+		h := srv.hash(args[1])
+		if h == nil {
+			h = make(map[string]string)
+			srv.hashes[args[1]] = h
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		fmt.Fprintf(w, ":%d\r\n", (len(args)-2)/2)
+	case "HGET":
+		v, ok := srv.hash(args[1])[args[2]]
+		bulk(v, ok)
+	case "HMGET":
+		h := srv.hash(args[1])
+		fmt.Fprintf(w, "*%d\r\n", len(args)-2)
+		for _, field := range args[2:] {
+			v, ok := h[field]
+			bulk(v, ok)
+		}
+	case "HGETALL":
+		h := srv.hash(args[1])
+		fmt.Fprintf(w, "*%d\r\n", 2*len(h))
+		for k, v := range h {
+			bulk(k, true)
+			bulk(v, true)
+		}
+	case "RENAME":
+		if srv.hash(args[1]) == nil {
+			w.WriteString("-ERR no such key\r\n")
+			break
+		}
+		srv.hashes[args[2]] = srv.hashes[args[1]]
+		delete(srv.hashes, args[1])
+		if exp, ok := srv.expires[args[1]]; ok {
+			srv.expires[args[2]] = exp
+			delete(srv.expires, args[1])
+		}
+		w.WriteString("+OK\r\n")
+	case "HDEL":
+		delete(srv.hash(args[1]), args[2])
+		w.WriteString(":1\r\n")
+	case "HKEYS":
+		h := srv.hash(args[1])
+		fmt.Fprintf(w, "*%d\r\n", len(h))
+		for k := range h {
+			bulk(k, true)
+		}
+	case "DEL":
+		delete(srv.hashes, args[1])
+		delete(srv.expires, args[1])
+		w.WriteString(":1\r\n")
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		if srv.hash(args[1]) != nil {
+			srv.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		w.WriteString(":1\r\n")
+	case "PTTL":
+		if srv.hash(args[1]) == nil {
+			w.WriteString(":-2\r\n")
+		} else if exp, ok := srv.expires[args[1]]; ok {
+			fmt.Fprintf(w, ":%d\r\n", time.Until(exp).Milliseconds())
+		} else {
+			w.WriteString(":-1\r\n")
+		}
+	case "SCAN":
+		var keys []string
+		for key := range srv.hashes {
+			if ok, _ := path.Match(args[3], key); ok && srv.hash(key) != nil {
+				keys = append(keys, key)
+			}
+		}
+		fmt.Fprintf(w, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, key := range keys {
+			bulk(key, true)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	srv := newRespServer(t, "secret")
+	store := NewRedisStore(srv.addr(), nil)
+	defer store.Close()
+	if err := store.Ping(); err == nil {
+		t.Errorf("wanted error without password")
+	}
+	store.SetPassword("secret")
+	if err := store.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	sid := store.PutValue("unknown", "name", "chris")
+	if len(sid) != 32 {
+		t.Fatalf("wanted new session id but was %q", sid)
+	}
+	if store.PutValue(sid, "count", 2) != sid {
+		t.Errorf("wanted same session id")
+	}
+	if v := store.GetValue(sid, "name"); v != "chris" {
+		t.Errorf("wanted chris but was %v", v)
+	}
+	if v := store.GetValue(sid, "count"); v != 2 {
+		t.Errorf("wanted 2 but was %v", v)
+	}
+	if v := store.GetValue(sid, "other"); v != nil {
+		t.Errorf("wanted nil but was %v", v)
+	}
+	infos := store.GetSessionInfos()
+	if len(infos) != 1 || infos[sid]["name"] != "chris" {
+		t.Errorf("wrong infos %v", infos)
+	}
+	srv.mx.Lock()
+	srv.hashes[store.key(sid)]["v:bad"] = "not a value"
+	srv.mx.Unlock()
+	if v := store.GetValue(sid, "bad"); v != nil {
+		t.Errorf("wanted nil for corrupt value but was %v", v)
+	}
+	srv.mx.Lock()
+	if _, ok := srv.hashes[store.key(sid)]["v:bad"]; ok {
+		t.Errorf("wanted corrupt value to be removed")
+	}
+	srv.mx.Unlock()
+	// TTLs
+	expiry, persistent := store.SessionExpiry(sid)
+	if persistent || time.Until(expiry) < 29*time.Minute {
+		t.Errorf("wrong expiry %v %v", expiry, persistent)
+	}
+	store.SetSessionLifetime(sid, 24*time.Hour, 0)
+	expiry, persistent = store.SessionExpiry(sid)
+	if !persistent || time.Until(expiry) < 23*time.Hour {
+		t.Errorf("wrong persistent expiry %v %v", expiry, persistent)
+	}
+	store.SetIdleTimeout(50 * time.Millisecond)
+	sid2 := store.PutValue("", "name", "chris")
+	time.Sleep(100 * time.Millisecond)
+	if v := store.GetValue(sid2, "name"); v != nil {
+		t.Errorf("wanted expired session but was %v", v)
+	}
+	newSid := store.RenameSession(sid)
+	if store.GetValue(sid, "name") != nil || store.GetValue(newSid, "name") != "chris" {
+		t.Errorf("wanted renamed session")
+	}
+	if _, persistent := store.SessionExpiry(newSid); !persistent {
+		t.Errorf("wanted renamed session to keep its TTL")
+	}
+	if store.RenameSession("unknown") != "" {
+		t.Errorf("wanted empty sid for unknown session")
+	}
+	sid = newSid
+	store.KillSession(sid)
+	if v := store.GetValue(sid, "name"); v != nil {
+		t.Errorf("wanted killed session but was %v", v)
+	}
+}
+
+func TestRedisStoreTimeout(t *testing.T) {
+	// a server that accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	store := NewRedisStore(ln.Addr().String(), nil)
+	defer store.Close()
+	store.SetTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if err := store.Ping(); err == nil {
+		t.Errorf("wanted timeout error")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("wanted timeout after 50ms but was %v", d)
+	}
+}
@@ -1,7 +1,12 @@
 package wuppo
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // Req provides information about a HTTP request and stores response data.
@@ -19,19 +24,68 @@ type Req interface {
 	// Path returns the URL path of the request.
 	Path() string
 
+	// RequestID returns the id that the access log assigned to this
+	// request, or the empty string if there is no access log.
+	RequestID() string
+
+	// PathParam returns the value of a named path parameter matched by a
+	// Router, or the empty string if there is no such parameter.
+	PathParam(name string) string
+
+	// Host returns the host of the request, from the Host header or the
+	// request URL, for instance "example.com:8080".
+	Host() string
+
+	// Header returns the first value of a named request header, or the
+	// empty string if the request has no such header.
+	Header(name string) string
+
+	// Cookie returns the value of a named request cookie, or the empty
+	// string if the request has no such cookie.
+	Cookie(name string) string
+
+	// ClientIP returns the IP address of the client. If the request came
+	// through a trusted proxy, see WithTrustedProxies, it is taken from
+	// the forwarded header, see WithForwardedHeader, otherwise it is the
+	// remote address of the connection.
+	ClientIP() string
+
+	// UserAgent returns the User-Agent header of the request.
+	UserAgent() string
+
+	// AcceptLanguages returns the language tags of the Accept-Language
+	// header of the request, the preferred language first, for instance
+	// ["de-DE", "de", "en"].
+	AcceptLanguages() []string
+
 	// HasFormValue returns true if this request has the named form value,
-    // either as a query string or a POST request parameter.
+	// either as a query string or a POST request parameter.
 	HasFormValue(name string) bool
 
 	// FormValue returns the value of a request parameter, or the empty
-    // string if the request parameter was not found in the query string or
-    // in the POST content.
+	// string if the request parameter was not found in the query string or
+	// in the POST content.
 	FormValue(name string) string
 
+	// QueryValue returns the value of a query string parameter, or the
+	// empty string if the query string has no such parameter.
+	QueryValue(name string) string
+
+	// PostFormValue returns the value of a parameter in the POST, PUT or
+	// PATCH content, or the empty string if the content has no such
+	// parameter. Unlike FormValue, it ignores the query string.
+	PostFormValue(name string) string
+
+	// BindJSON decodes the JSON request body into v. It returns an error if
+	// the body is not valid JSON, is too large, or has a Content-Type other
+	// than JSON. See JSONOptions.
+	BindJSON(v interface{}) error
+
 	// SetModelValue sets a keyed model value.
 	SetModelValue(key string, value interface{})
 
-	// ModelValue returns a keyed model value.
+	// ModelValue returns a keyed model value. See ModelGet for a typed
+	// variant.
 	ModelValue(key string) interface{}
 
 	// Model returns the model as a map.
@@ -44,52 +98,306 @@ type Req interface {
 
 	// SessionValue returns the named session value. If the key
 	// was not found or this request has no valid session, it returns nil.
+	// See SessionGet for a typed variant.
 	SessionValue(name string) interface{}
 
-	// KillSession kills the session associated with this request.
+	// DeleteSessionValue removes a named value from the session.
+	DeleteSessionValue(name string)
+
+	// SessionKeys returns the sorted names of the session values. Names
+	// that start with an underscore are reserved for wuppo, like the CSRF
+	// token and the flashes, and are not returned. If the session store is
+	// not a KeyStore, it reads all sessions to find the names.
+	SessionKeys() []string
+
+	// ClearSession removes the session values that SessionKeys returns,
+	// but keeps the session, its id and the reserved values, unlike
+	// KillSession. So forms with the CSRF token of the session stay
+	// valid.
+	ClearSession()
+
+	// SetSessionLifetime overrides the idle timeout and the maximum
+	// lifetime of the session associated with this request, for instance
+	// to implement "remember me". A zero duration keeps the default of the
+	// session store. The session cookie then lasts as long as the session.
+	// It does nothing if the request has no valid session, or if the
+	// session store is not a LifetimeStore.
+	SetSessionLifetime(idleTimeout time.Duration, maxLifetime time.Duration)
+
+	// KillSession kills the session associated with this request and
+	// deletes the session cookie in the browser.
 	KillSession()
 
+	// RegenerateSession moves the session associated with this request to
+	// a new session id and sends the new id in the session cookie, so a
+	// session id that was known before cannot be used anymore. Call it
+	// when the privileges of a session change, for instance after a
+	// login. The CSRF token is renewed too. If the session store is not a
+	// RenameStore, the session is killed instead, and the next
+	// SetSessionValue creates a new one.
+	RegenerateSession()
+
+	// AddFlash adds a one-shot message to the session, which is kept until
+	// it is read with Flashes, for instance after a redirect. If the
+	// request has no valid session, it creates one.
+	AddFlash(kind string, message string)
+
+	// Flashes returns the flash messages of the session and removes them.
+	// Template responses have the flashes in the model value "flashes",
+	// unless the request has read them before or has set that model value.
+	Flashes() []Flash
+
+	// CSRFToken returns the CSRF token of the session, for instance to
+	// hand it to a script, which sends it in a request header. If the
+	// session has no token yet, it creates one, and a session if the
+	// request has no valid session. See CSRFConfig.
+	CSRFToken() string
+
+	// SetHeader sets a response header, replacing its values. Use
+	// SetCookie to set cookies.
+	SetHeader(name string, value string)
+
+	// AddHeader adds a value to a response header.
+	AddHeader(name string, value string)
+
+	// SetCookie adds a Set-Cookie header to the response. Invalid cookies
+	// are dropped, see http.SetCookie.
+	SetCookie(cookie *http.Cookie)
+
+	// DeleteCookie tells the browser to delete the named cookie with path
+	// "/". Use SetCookie with a negative MaxAge to delete a cookie with
+	// another path or a domain.
+	DeleteCookie(name string)
+
 	// SetHTML sets a html reponse.
 	SetHTML(html string)
 
 	// SetTemplate sets a template reponse.
 	SetTemplate(template string)
 
-	// SetRedirect sets a redirect reponse.
+	// SetLayout sets the layout that the template response is rendered in,
+	// overriding the layout the template declares and the default layout.
+	// An empty layout renders the template without layout, for instance
+	// for HTML fragments.
+	SetLayout(layout string)
+
+	// SetBytes sets a response with a content type and a body, for
+	// instance a generated image. An empty contentType is detected from
+	// the data.
+	SetBytes(contentType string, data []byte)
+
+	// SetFile sets a response with the content of the file at path. The
+	// content type is taken from the file extension, and range and
+	// conditional requests are supported, see http.ServeContent. If the
+	// file does not exist, the response has the error page for status 404.
+	// The path must not come unchecked from the request.
+	SetFile(path string)
+
+	// SetReader sets a response with the content of a reader, like
+	// SetFile. The name determines the content type, and a non-zero
+	// modtime enables conditional requests. If the reader is an
+	// io.Closer, it is closed after the request was served.
+	SetReader(name string, modtime time.Time, content io.ReadSeeker)
+
+	// SetStream sets a response whose body is written by a function, for
+	// large generated output that should not be held in memory. The
+	// content type is detected from the first bytes, unless set with
+	// SetHeader. If the function returns an error before it has written
+	// anything, the response has the error page for status 500; later
+	// errors are logged. The writer is a http.Flusher.
+	SetStream(write func(w io.Writer) error)
+
+	// SetDownload makes the browser save the response as a file with the
+	// filename, instead of showing it, by setting the Content-Disposition
+	// header.
+	SetDownload(filename string)
+
+	// SetJSON sets a JSON response.
+	SetJSON(v interface{})
+
+	// SetJSONStatus sets a JSON response with a status code.
+	SetJSONStatus(code int, v interface{})
+
+	// SetRedirect sets a redirect reponse. The status code is 302 Found,
+	// unless SetStatus set a redirect status.
 	SetRedirect(url string)
 
-	// SetStatus sets a status reponse.
+	// SetRedirectStatus sets a redirect response with a status code, for
+	// instance http.StatusMovedPermanently or http.StatusSeeOther.
+	SetRedirectStatus(code int, url string)
+
+	// SetStatus sets the status code of the response. It applies to the
+	// HTML, template and JSON responses too, for instance to render a
+	// "404.html" template with status 404. Without such a response, a
+	// status of 400 or more renders the error page for the status.
 	SetStatus(code int)
 }
 
 // reqImpl is the default implementation of Req. It's based on a
 // http.Request and a http.ResponseWriter
 type reqImpl struct {
-	w        http.ResponseWriter
-	r        *http.Request
-	store    SessionStore
-	sid      string
-	model    map[string]interface{}
-	html     string
-	template string
-	redirect string
-	status   int
-}
-
-func newReqImpl(w http.ResponseWriter, r *http.Request, store SessionStore) *reqImpl {
+	w         http.ResponseWriter
+	r         *http.Request
+	handler   *Handler
+	store     SessionStore
+	sid       string
+	params    map[string]string
+	model     map[string]interface{}
+	html      string
+	template  string
+	layout    string
+	hasLayout bool
+	json      interface{}
+	hasJSON   bool
+	bytes     []byte
+	bytesType string
+	hasBytes  bool
+	file      string
+	reader    io.ReadSeeker
+	name      string
+	modtime   time.Time
+	stream    func(w io.Writer) error
+	redirect  string
+	status    int
+	header    http.Header
+	cookies   []*http.Cookie
+	before    http.Header // the response headers before writeHeaders
+
+	regenerated bool
+	cookieDirty bool           // the session cookie must be written
+	session     RequestSession // the session of a RequestStore
+}
+
+// newReqImpl creates a reqImpl without session. It does not call the
+// session store, so it cannot panic; see loadSession.
+func newReqImpl(w http.ResponseWriter, r *http.Request, handler *Handler) *reqImpl {
+	req := reqImpl{
+		w:       w,
+		r:       r,
+		handler: handler,
+		store:   handler.store,
+		model:   make(map[string]interface{}),
+		header:  make(http.Header),
+	}
+	return &req
+}
+
+// loadSession reads the session id from the session cookie and touches
+// the session. A RequestStore loads the session of the request, which is
+// the store of the request from then on. Session stores panic on I/O
+// errors, so the Handler calls it after it has installed its recovery.
+func (req *reqImpl) loadSession() {
 	sid := ""
-	if c, err := r.Cookie("WUPPO_SESSION_ID"); err == nil {
+	if c, err := req.r.Cookie(req.handler.cookie.Name); err == nil {
 		sid = c.Value
-		store.TouchSession(sid)
 	}
-	req := reqImpl{
-		w:     w,
-		r:     r,
-		store: store,
-		sid:   sid,
-		model: make(map[string]interface{}),
+	if rs, ok := req.handler.store.(RequestStore); ok {
+		req.session = rs.LoadSession(sid)
+		req.store = req.session
 	}
-	return &req
+	if sid == "" {
+		return
+	}
+	req.sid = sid
+	if ls, ok := req.store.(LifetimeStore); ok {
+		_, persistent := ls.TouchSessionExpiry(sid)
+		if persistent || req.handler.cookie.Persistent {
+			// the session was touched, so its cookie must last longer
+			req.cookieDirty = true
+		}
+	} else {
+		req.store.TouchSession(sid)
+	}
+}
+
+// sessionExpiry returns the time at which the session expires, and
+// whether the session is persistent. It returns the zero time if the
+// expiry is not known.
+func (req *reqImpl) sessionExpiry() (time.Time, bool) {
+	if ls, ok := req.store.(LifetimeStore); ok {
+		return ls.SessionExpiry(req.sid)
+	}
+	return time.Time{}, false
+}
+
+// writeSessionCookie sends the session cookie with a value. The cookie of
+// a persistent session expires together with the session, other session
+// cookies expire when the browser is closed. An empty value deletes the
+// cookie.
+func (req *reqImpl) writeSessionCookie(value string) {
+	cfg := req.handler.cookie
+	maxAge := -1
+	if value != "" {
+		maxAge = 0
+		expiry, persistent := req.sessionExpiry()
+		if (persistent || cfg.Persistent) && !expiry.IsZero() {
+			maxAge = int(time.Until(expiry).Seconds())
+			if maxAge <= 0 {
+				maxAge = -1
+			}
+		}
+	}
+	tls := forwardedTLS(req.r, req.handler.trustedProxies, req.handler.forwardedHeader)
+	http.SetCookie(req.w, cfg.cookie(tls, value, maxAge))
+}
+
+// commitSession writes the session cookie if the session id has changed,
+// or if the session of a RequestStore has changed. It is called after the
+// request was served and before the response is rendered, so the cookie
+// is written once per request. A killed session deletes the cookie.
+func (req *reqImpl) commitSession() error {
+	if req.session != nil {
+		value, changed, err := req.session.Commit()
+		if err == nil && changed {
+			err = checkCookieSize(req.handler.cookie.Name, value)
+		}
+		if err != nil || !changed {
+			return err
+		}
+		// the cookie expires with the session, which is found by its id,
+		// so the id is replaced by the cookie value afterwards
+		req.writeSessionCookie(value)
+		req.sid = value
+		return nil
+	}
+	if !req.cookieDirty {
+		return nil
+	}
+	req.cookieDirty = false
+	req.writeSessionCookie(req.sid)
+	return nil
+}
+
+// writeHeaders writes the headers and cookies that were set on req to the
+// response. It is called before the response is rendered, but not if
+// serving failed before, for instance with a panic, since these headers
+// are meant for the response that req set. If rendering fails, the error
+// page undoes it with discardHeaders.
+func (req *reqImpl) writeHeaders() {
+	header := req.w.Header()
+	req.before = header.Clone()
+	for name, values := range req.header {
+		header[name] = values
+	}
+	for _, cookie := range req.cookies {
+		http.SetCookie(req.w, cookie)
+	}
+}
+
+// discardHeaders undoes writeHeaders, for an error page that replaces
+// the response that req set.
+func (req *reqImpl) discardHeaders() {
+	if req.before == nil {
+		return
+	}
+	header := req.w.Header()
+	for name := range header {
+		delete(header, name)
+	}
+	for name, values := range req.before {
+		header[name] = values
+	}
+	req.before = nil
 }
 
 func (req *reqImpl) Method() string {
@@ -108,19 +416,86 @@ func (req *reqImpl) Path() string {
 	return req.r.URL.Path
 }
 
+func (req *reqImpl) RequestID() string {
+	if rec := accessRecordOf(req.r); rec != nil {
+		return rec.requestID
+	}
+	return ""
+}
+
+func (req *reqImpl) PathParam(name string) string {
+	return req.params[name]
+}
+
+func (req *reqImpl) setPathParams(params map[string]string) {
+	req.params = params
+}
+
+func (req *reqImpl) rawQuery() string {
+	return req.r.URL.RawQuery
+}
+
+func (req *reqImpl) Host() string {
+	return req.r.Host
+}
+
+func (req *reqImpl) Header(name string) string {
+	return req.r.Header.Get(name)
+}
+
+func (req *reqImpl) Cookie(name string) string {
+	c, err := req.r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+func (req *reqImpl) ClientIP() string {
+	return clientIP(req.r, req.handler.trustedProxies, req.handler.forwardedHeader)
+}
+
+func (req *reqImpl) UserAgent() string {
+	return req.r.UserAgent()
+}
+
+func (req *reqImpl) AcceptLanguages() []string {
+	return acceptLanguages(req.r.Header.Get("Accept-Language"))
+}
+
 func (req *reqImpl) HasFormValue(name string) bool {
 	v := req.r.FormValue(name)
-    if v != "" {
-        return true
-    }
-    _, ok := req.r.Form[name]
-    return ok
+	if v != "" {
+		return true
+	}
+	_, ok := req.r.Form[name]
+	return ok
 }
 
 func (req *reqImpl) FormValue(name string) string {
 	return req.r.FormValue(name)
 }
 
+func (req *reqImpl) QueryValue(name string) string {
+	return req.r.URL.Query().Get(name)
+}
+
+func (req *reqImpl) PostFormValue(name string) string {
+	return req.r.PostFormValue(name)
+}
+
+func (req *reqImpl) BindJSON(v interface{}) error {
+	if err := checkJSONContentType(req.r.Header.Get("Content-Type")); err != nil {
+		return err
+	}
+	opts := req.handler.jsonOptions
+	body := req.r.Body
+	if opts.MaxBytes > 0 {
+		body = http.MaxBytesReader(req.w, body, opts.MaxBytes)
+	}
+	return decodeJSON(body, v, opts)
+}
+
 func (req *reqImpl) SetModelValue(name string, value interface{}) {
 	req.model[name] = value
 }
@@ -134,16 +509,13 @@ func (req *reqImpl) Model() map[string]interface{} {
 }
 
 func (req *reqImpl) SetSessionValue(name string, value interface{}) {
+	if !req.regenerated && req.handler.rotateKeys[name] {
+		req.RegenerateSession()
+	}
 	newSid := req.store.PutValue(req.sid, name, value)
 	if newSid != req.sid {
 		req.sid = newSid
-		cookie := http.Cookie{
-			Name:     "WUPPO_SESSION_ID",
-			Value:    newSid,
-			MaxAge:   0,
-			HttpOnly: true,
-		}
-		http.SetCookie(req.w, &cookie)
+		req.cookieDirty = true
 	}
 }
 
@@ -151,8 +523,142 @@ func (req *reqImpl) SessionValue(name string) interface{} {
 	return req.store.GetValue(req.sid, name)
 }
 
+func (req *reqImpl) DeleteSessionValue(name string) {
+	if req.sid == "" {
+		return
+	}
+	if ks, ok := req.store.(KeyStore); ok {
+		ks.DeleteValue(req.sid, name)
+	} else if req.store.GetValue(req.sid, name) != nil {
+		req.store.PutValue(req.sid, name, nil)
+	}
+}
+
+// sessionKeys returns the sorted names of all session values, reserved
+// or not. If the store is not a KeyStore, it finds them in
+// GetSessionInfos, which has values set to nil too.
+func (req *reqImpl) sessionKeys() []string {
+	if req.sid == "" {
+		return nil
+	}
+	if ks, ok := req.store.(KeyStore); ok {
+		return ks.GetKeys(req.sid)
+	}
+	values := make(map[string]interface{})
+	for key, value := range req.store.GetSessionInfos()[req.sid] {
+		if value != nil {
+			values[key] = value
+		}
+	}
+	return sortedKeys(values)
+}
+
+// reservedKey returns true if a session key is reserved for wuppo. The
+// infos of GetSessionInfos have reserved keys too, like "_sid".
+func reservedKey(key string) bool {
+	return strings.HasPrefix(key, "_")
+}
+
+func (req *reqImpl) SessionKeys() []string {
+	keys := []string{}
+	for _, key := range req.sessionKeys() {
+		if !reservedKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (req *reqImpl) ClearSession() {
+	for _, key := range req.SessionKeys() {
+		req.DeleteSessionValue(key)
+	}
+}
+
+func (req *reqImpl) SetSessionLifetime(idleTimeout time.Duration, maxLifetime time.Duration) {
+	ls, ok := req.store.(LifetimeStore)
+	if !ok || req.sid == "" {
+		return
+	}
+	if expiry, _ := ls.SessionExpiry(req.sid); expiry.IsZero() {
+		return
+	}
+	ls.SetSessionLifetime(req.sid, idleTimeout, maxLifetime)
+	req.cookieDirty = true
+}
+
+func (req *reqImpl) RegenerateSession() {
+	req.regenerated = true
+	if req.sid == "" {
+		return
+	}
+	if rs, ok := req.store.(RenameStore); ok {
+		if newSid := rs.RenameSession(req.sid); newSid != "" {
+			req.sid = newSid
+			req.cookieDirty = true
+			// whoever knew the old session must not know the new token
+			req.DeleteSessionValue(csrfKey)
+			return
+		}
+	} else {
+		req.store.KillSession(req.sid)
+	}
+	req.sid = ""
+	req.cookieDirty = true
+}
+
 func (req *reqImpl) KillSession() {
-	req.store.KillSession(req.sid)
+	if req.sid != "" {
+		req.store.KillSession(req.sid)
+		req.sid = ""
+		req.cookieDirty = true
+	}
+}
+
+func (req *reqImpl) AddFlash(kind string, message string) {
+	flashes := toFlashes(req.SessionValue(flashKey))
+	req.SetSessionValue(flashKey, append(flashes, Flash{kind, message}))
+}
+
+func (req *reqImpl) Flashes() []Flash {
+	flashes := toFlashes(req.SessionValue(flashKey))
+	if len(flashes) > 0 {
+		req.SetSessionValue(flashKey, []Flash{})
+	}
+	return flashes
+}
+
+// exposeFlashes reads the flashes into the model of a template response,
+// unless the model already has a value for them.
+func (req *reqImpl) exposeFlashes() {
+	if _, ok := req.model[flashModelKey]; !ok {
+		req.model[flashModelKey] = req.Flashes()
+	}
+}
+
+func (req *reqImpl) CSRFToken() string {
+	token, _ := req.SessionValue(csrfKey).(string)
+	if token == "" {
+		token = newSessionID()
+		req.SetSessionValue(csrfKey, token)
+	}
+	return token
+}
+
+func (req *reqImpl) SetHeader(name string, value string) {
+	req.header.Set(name, value)
+}
+
+func (req *reqImpl) AddHeader(name string, value string) {
+	req.header.Add(name, value)
+}
+
+func (req *reqImpl) SetCookie(cookie *http.Cookie) {
+	req.cookies = append(req.cookies, cookie)
+}
+
+func (req *reqImpl) DeleteCookie(name string) {
+	req.SetCookie(&http.Cookie{Name: name, Path: "/", MaxAge: -1})
 }
 
 func (req *reqImpl) SetHTML(html string) {
@@ -163,10 +669,102 @@ func (req *reqImpl) SetTemplate(template string) {
 	req.template = template
 }
 
+func (req *reqImpl) SetLayout(layout string) {
+	req.layout = layout
+	req.hasLayout = true
+}
+
+func (req *reqImpl) SetBytes(contentType string, data []byte) {
+	req.bytes = data
+	req.bytesType = contentType
+	req.hasBytes = true
+}
+
+func (req *reqImpl) SetFile(path string) {
+	req.file = path
+}
+
+func (req *reqImpl) SetReader(name string, modtime time.Time, content io.ReadSeeker) {
+	req.reader = content
+	req.name = name
+	req.modtime = modtime
+}
+
+func (req *reqImpl) SetStream(write func(w io.Writer) error) {
+	req.stream = write
+}
+
+func (req *reqImpl) SetDownload(filename string) {
+	req.SetHeader("Content-Disposition", contentDisposition(filename))
+}
+
+func (req *reqImpl) SetJSON(v interface{}) {
+	req.json = v
+	req.hasJSON = true
+}
+
+func (req *reqImpl) SetJSONStatus(code int, v interface{}) {
+	req.SetJSON(v)
+	req.status = code
+}
+
 func (req *reqImpl) SetRedirect(url string) {
 	req.redirect = url
 }
 
+func (req *reqImpl) SetRedirectStatus(code int, url string) {
+	req.SetRedirect(url)
+	req.status = code
+}
+
+// redirectStatus returns the status code of a redirect response.
+func (req *reqImpl) redirectStatus() int {
+	if req.status >= 300 && req.status < 400 {
+		return req.status
+	}
+	return http.StatusFound
+}
+
+// checkResponse returns an error if req has more than one kind of
+// response, or a redirect with a status that is no redirect status.
+func (req *reqImpl) checkResponse() error {
+	var kinds []string
+	if req.html != "" {
+		kinds = append(kinds, "HTML")
+	}
+	if req.template != "" {
+		kinds = append(kinds, "template "+req.template)
+	}
+	if req.hasJSON {
+		kinds = append(kinds, "JSON")
+	}
+	if req.hasBytes {
+		kinds = append(kinds, "bytes")
+	}
+	if req.file != "" {
+		kinds = append(kinds, "file "+req.file)
+	}
+	if req.reader != nil {
+		kinds = append(kinds, "reader "+req.name)
+	}
+	if req.stream != nil {
+		kinds = append(kinds, "stream")
+	}
+	if req.redirect != "" {
+		kinds = append(kinds, "redirect to "+req.redirect)
+	}
+	if len(kinds) > 1 {
+		return fmt.Errorf("conflicting responses %s, the first one wins", strings.Join(kinds, ", "))
+	}
+	if (req.file != "" || req.reader != nil) && req.status != 0 {
+		return fmt.Errorf("%s with status %d, which http.ServeContent sets", kinds[0], req.status)
+	}
+	if req.redirect != "" && req.status != 0 && req.redirectStatus() != req.status {
+		return fmt.Errorf("redirect to %s with status %d, which is no redirect status", req.redirect, req.status)
+	}
+	return nil
+}
+
 func (req *reqImpl) SetStatus(code int) {
 	req.status = code
 }
@@ -174,25 +772,62 @@ func (req *reqImpl) SetStatus(code int) {
 // ReqStub implements Req but can be created and manipulated programmatically.
 // Used for unit testing.
 type ReqStub struct {
-	MethodString string
-	PathString   string
-	FormValueMap map[string]string
-	ModelMap     map[string]interface{}
-	SessionMap   map[string]interface{}
-	HTML         string
-	Template     string
-	Redirect     string
-	Status       int
+	MethodString    string
+	PathString      string
+	RawQueryString  string
+	RequestIDString string
+	PathParamMap    map[string]string
+	HostString      string
+	HeaderMap       http.Header
+	CookieMap       map[string]string
+	ClientIPString  string
+	FormValueMap    map[string]string
+	QueryValueMap   map[string]string
+	PostFormMap     map[string]string
+	Body            []byte
+	JSONOptions     JSONOptions
+	ModelMap        map[string]interface{}
+	SessionMap      map[string]interface{}
+	IdleTimeout     time.Duration
+	MaxLifetime     time.Duration
+	Regenerated     bool
+	FlashList       []Flash
+	CSRFTokenString string
+	ResponseHeader  http.Header
+	CookieList      []*http.Cookie
+	Bytes           []byte
+	ContentType     string
+	File            string
+	Reader          io.ReadSeeker
+	ReaderName      string
+	ReaderModtime   time.Time
+	Stream          func(w io.Writer) error
+	Download        string
+	HTML            string
+	Template        string
+	Layout          string
+	HasLayout       bool
+	JSON            interface{}
+	HasJSON         bool
+	Redirect        string
+	Status          int
 }
 
 // NewReqStub creates a new ReqStub.
 func NewReqStub(method string, path string) *ReqStub {
 	req := ReqStub{
-		MethodString: method,
-		PathString:   path,
-		FormValueMap: make(map[string]string),
-		ModelMap:     make(map[string]interface{}),
-		SessionMap:   make(map[string]interface{}),
+		MethodString:   method,
+		PathString:     path,
+		PathParamMap:   make(map[string]string),
+		HeaderMap:      make(http.Header),
+		CookieMap:      make(map[string]string),
+		FormValueMap:   make(map[string]string),
+		QueryValueMap:  make(map[string]string),
+		PostFormMap:    make(map[string]string),
+		ResponseHeader: make(http.Header),
+		JSONOptions:    DefaultJSONOptions,
+		ModelMap:       make(map[string]interface{}),
+		SessionMap:     make(map[string]interface{}),
 	}
 	return &req
 }
@@ -217,19 +852,88 @@ func (req *ReqStub) Path() string {
 	return req.PathString
 }
 
+// RequestID returns the request id.
+func (req *ReqStub) RequestID() string {
+	return req.RequestIDString
+}
+
+// PathParam returns the value of a named path parameter.
+func (req *ReqStub) PathParam(name string) string {
+	return req.PathParamMap[name]
+}
+
+func (req *ReqStub) setPathParams(params map[string]string) {
+	req.PathParamMap = params
+}
+
+func (req *ReqStub) rawQuery() string {
+	return req.RawQueryString
+}
+
+// Host returns HostString.
+func (req *ReqStub) Host() string {
+	return req.HostString
+}
+
+// Header returns the first value of a named header in HeaderMap.
+func (req *ReqStub) Header(name string) string {
+	return req.HeaderMap.Get(name)
+}
+
+// Cookie returns the value of a named cookie in CookieMap.
+func (req *ReqStub) Cookie(name string) string {
+	return req.CookieMap[name]
+}
+
+// ClientIP returns ClientIPString.
+func (req *ReqStub) ClientIP() string {
+	return req.ClientIPString
+}
+
+// UserAgent returns the User-Agent header in HeaderMap.
+func (req *ReqStub) UserAgent() string {
+	return req.HeaderMap.Get("User-Agent")
+}
+
+// AcceptLanguages returns the language tags of the Accept-Language header
+// in HeaderMap, the preferred language first.
+func (req *ReqStub) AcceptLanguages() []string {
+	return acceptLanguages(req.HeaderMap.Get("Accept-Language"))
+}
+
 // HasFormValue returns true if this request has the named form value,
 // either as a query string or a POST request parameter.
 func (req *ReqStub) HasFormValue(name string) bool {
 	_, ok := req.FormValueMap[name]
-    return ok
+	return ok
 }
 
-
 // FormValue returns the value of a request parameter.
 func (req *ReqStub) FormValue(name string) string {
 	return req.FormValueMap[name]
 }
 
+// QueryValue returns the value of a query string parameter in
+// QueryValueMap. Unlike the Req of a Handler, ReqStub does not merge
+// QueryValueMap and PostFormMap into FormValueMap.
+func (req *ReqStub) QueryValue(name string) string {
+	return req.QueryValueMap[name]
+}
+
+// PostFormValue returns the value of a POST parameter in PostFormMap.
+func (req *ReqStub) PostFormValue(name string) string {
+	return req.PostFormMap[name]
+}
+
+// BindJSON decodes Body into v, honoring JSONOptions.
+func (req *ReqStub) BindJSON(v interface{}) error {
+	opts := req.JSONOptions
+	if opts.MaxBytes > 0 && int64(len(req.Body)) > opts.MaxBytes {
+		return &http.MaxBytesError{Limit: opts.MaxBytes}
+	}
+	return decodeJSON(bytes.NewReader(req.Body), v, opts)
+}
+
 // SetModelValue sets a keyed model value.
 func (req *ReqStub) SetModelValue(name string, value interface{}) {
 	req.ModelMap[name] = value
@@ -258,11 +962,87 @@ func (req *ReqStub) SessionValue(name string) interface{} {
 	return req.SessionMap[name]
 }
 
+// DeleteSessionValue removes a value from SessionMap.
+func (req *ReqStub) DeleteSessionValue(name string) {
+	delete(req.SessionMap, name)
+}
+
+// SessionKeys returns the sorted keys of SessionMap, without the keys
+// that start with an underscore.
+func (req *ReqStub) SessionKeys() []string {
+	keys := []string{}
+	for _, key := range sortedKeys(req.SessionMap) {
+		if !reservedKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ClearSession removes the values from SessionMap that SessionKeys
+// returns.
+func (req *ReqStub) ClearSession() {
+	for _, key := range req.SessionKeys() {
+		delete(req.SessionMap, key)
+	}
+}
+
+// SetSessionLifetime records the lifetime of the session in IdleTimeout
+// and MaxLifetime.
+func (req *ReqStub) SetSessionLifetime(idleTimeout time.Duration, maxLifetime time.Duration) {
+	req.IdleTimeout = idleTimeout
+	req.MaxLifetime = maxLifetime
+}
+
 // KillSession kills the session associated with this request.
 func (req *ReqStub) KillSession() {
 	req.SessionMap = nil
 }
 
+// RegenerateSession records the regeneration of the session in
+// Regenerated.
+func (req *ReqStub) RegenerateSession() {
+	req.Regenerated = true
+}
+
+// AddFlash appends a flash message to FlashList.
+func (req *ReqStub) AddFlash(kind string, message string) {
+	req.FlashList = append(req.FlashList, Flash{kind, message})
+}
+
+// Flashes returns FlashList and clears it.
+func (req *ReqStub) Flashes() []Flash {
+	flashes := req.FlashList
+	req.FlashList = nil
+	return flashes
+}
+
+// CSRFToken returns the CSRF token.
+func (req *ReqStub) CSRFToken() string {
+	return req.CSRFTokenString
+}
+
+// SetHeader sets a header in ResponseHeader.
+func (req *ReqStub) SetHeader(name string, value string) {
+	req.ResponseHeader.Set(name, value)
+}
+
+// AddHeader adds a header value to ResponseHeader.
+func (req *ReqStub) AddHeader(name string, value string) {
+	req.ResponseHeader.Add(name, value)
+}
+
+// SetCookie appends a cookie to CookieList.
+func (req *ReqStub) SetCookie(cookie *http.Cookie) {
+	req.CookieList = append(req.CookieList, cookie)
+}
+
+// DeleteCookie appends a cookie with path "/" and a negative MaxAge to
+// CookieList.
+func (req *ReqStub) DeleteCookie(name string) {
+	req.SetCookie(&http.Cookie{Name: name, Path: "/", MaxAge: -1})
+}
+
 // SetHTML sets a html reponse.
 func (req *ReqStub) SetHTML(html string) {
 	req.HTML = html
@@ -273,11 +1053,64 @@ func (req *ReqStub) SetTemplate(template string) {
 	req.Template = template
 }
 
+// SetLayout sets the layout that the template response is rendered in.
+func (req *ReqStub) SetLayout(layout string) {
+	req.Layout = layout
+	req.HasLayout = true
+}
+
+// SetBytes sets a response with a content type and a body.
+func (req *ReqStub) SetBytes(contentType string, data []byte) {
+	req.ContentType = contentType
+	req.Bytes = data
+}
+
+// SetFile sets a file response.
+func (req *ReqStub) SetFile(path string) {
+	req.File = path
+}
+
+// SetReader sets a reader response.
+func (req *ReqStub) SetReader(name string, modtime time.Time, content io.ReadSeeker) {
+	req.Reader = content
+	req.ReaderName = name
+	req.ReaderModtime = modtime
+}
+
+// SetStream sets a stream response. Tests call Stream with a buffer to
+// check the body.
+func (req *ReqStub) SetStream(write func(w io.Writer) error) {
+	req.Stream = write
+}
+
+// SetDownload records the filename in Download.
+func (req *ReqStub) SetDownload(filename string) {
+	req.Download = filename
+}
+
+// SetJSON sets a JSON response.
+func (req *ReqStub) SetJSON(v interface{}) {
+	req.JSON = v
+	req.HasJSON = true
+}
+
+// SetJSONStatus sets a JSON response with a status code.
+func (req *ReqStub) SetJSONStatus(code int, v interface{}) {
+	req.SetJSON(v)
+	req.Status = code
+}
+
 // SetRedirect sets a redirect reponse.
 func (req *ReqStub) SetRedirect(url string) {
 	req.Redirect = url
 }
 
+// SetRedirectStatus sets a redirect response with a status code.
+func (req *ReqStub) SetRedirectStatus(code int, url string) {
+	req.SetRedirect(url)
+	req.Status = code
+}
+
 // SetStatus sets a status reponse.
 func (req *ReqStub) SetStatus(code int) {
 	req.Status = code
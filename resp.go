@@ -0,0 +1,108 @@
+package wuppo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// respError is an error reply of a RESP server.
+type respError string
+
+func (e respError) Error() string {
+	return "wuppo: redis: " + string(e)
+}
+
+// respConn is a connection to a server that speaks RESP, the Redis
+// serialization protocol.
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func newRespConn(conn net.Conn) *respConn {
+	return &respConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+}
+
+// do sends commands in a pipeline and returns their replies. A reply is a
+// string, an int64, nil, a []interface{} or a respError. The returned
+// error is an I/O or protocol error, after which the connection must not
+// be used anymore.
+func (c *respConn) do(cmds ...[]string) ([]interface{}, error) {
+	for _, args := range cmds {
+		writeRESP(c.w, args)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		reply, err := readRESP(c.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// writeRESP writes a command as an array of bulk strings.
+func writeRESP(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// readRESP reads a reply. Bulk strings and simple strings are returned as
+// string, integers as int64, nil replies as nil, arrays as []interface{}
+// and error replies as respError.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("wuppo: redis: invalid reply line")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return respError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("wuppo: redis: invalid reply type %q", kind)
+}
@@ -0,0 +1,304 @@
+package wuppo
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Router dispatches requests to ServeFuncs by request method and path
+// pattern. A Router plugs into a Handler through its Serve method:
+//
+//	router := wuppo.NewRouter()
+//	router.Get("/users/{id}", serveUser)
+//	router.Get("/users/{id}/posts/{slug}", servePost)
+//	router.Get("/static/{path...}", serveStatic)
+//	handler, err := wuppo.New(router.Serve, wuppo.WithSessionStore(store))
+//
+// A pattern is a list of slash-separated segments. A segment is either
+// static text, a named parameter "{name}" that matches exactly one
+// non-empty path segment, or a wildcard "{name...}" that matches the rest of
+// the path and must be the last segment. Matched values are available
+// through Req.PathParam. Static segments take precedence over parameters,
+// and parameters take precedence over wildcards.
+//
+// Middlewares added with Use wrap the ServeFuncs of a Router. Group creates
+// a sub-router for a path prefix that shares the routes of its parent but
+// may add its own middlewares:
+//
+//	admin := router.Group("/admin")
+//	admin.Use(requireAdmin)
+//	admin.Get("/users", serveUsers) // serves "/admin/users"
+//
+// A trailing slash is significant: "/users/" and "/users" are different
+// patterns. If a path does not match, but would match with the trailing
+// slash added or removed, the Router redirects to that path, with status
+// 301 for GET and HEAD requests and 308 for other requests.
+type Router struct {
+	root        *routeNode
+	parent      *Router
+	prefix      string
+	middlewares []Middleware
+
+	// NotFound is called if no pattern matches the request path.
+	// If nil, the Router sets status 404.
+	NotFound ServeFunc
+
+	// MethodNotAllowed is called if a pattern matches the request path but
+	// no ServeFunc was registered for the request method.
+	// If nil, the Router sets status 405.
+	MethodNotAllowed ServeFunc
+
+	// RedirectTrailingSlash enables redirects to the path with the trailing
+	// slash added or removed. NewRouter sets it to true.
+	RedirectTrailingSlash bool
+}
+
+// NewRouter creates a new, empty Router.
+func NewRouter() *Router {
+	rt := &Router{
+		root:                  &routeNode{},
+		RedirectTrailingSlash: true,
+	}
+	return rt
+}
+
+// Group creates a sub-router whose patterns are prefixed with prefix.
+// The sub-router runs the middlewares of its parent, followed by its own.
+func (rt *Router) Group(prefix string) *Router {
+	if !strings.HasPrefix(prefix, "/") {
+		panic("wuppo: group prefix " + prefix + " must begin with '/'")
+	}
+	g := &Router{
+		root:   rt.root,
+		parent: rt,
+		prefix: rt.prefix + strings.TrimSuffix(prefix, "/"),
+	}
+	return g
+}
+
+// Use appends middlewares to the Router. They wrap all ServeFuncs
+// registered on this Router and its groups, no matter if they were
+// registered before or after the call to Use. Middlewares of the top-level
+// Router also wrap the NotFound and MethodNotAllowed ServeFuncs.
+func (rt *Router) Use(middlewares ...Middleware) {
+	rt.middlewares = append(rt.middlewares, middlewares...)
+}
+
+// Handle registers a ServeFunc for a request method and a path pattern.
+// An empty method matches any request method. A GET ServeFunc also serves
+// HEAD requests, unless a HEAD ServeFunc is registered for the same pattern.
+// Handle panics if the pattern is malformed or was already registered for
+// the method.
+func (rt *Router) Handle(method string, pattern string, serve ServeFunc) {
+	if !strings.HasPrefix(pattern, "/") {
+		panic("wuppo: pattern " + pattern + " must begin with '/'")
+	}
+	pattern = rt.prefix + pattern
+	n := rt.root
+	segs := splitPath(pattern)
+	for i, seg := range segs {
+		switch {
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "...}"):
+			if i != len(segs)-1 {
+				panic("wuppo: wildcard in pattern " + pattern + " must be the last segment")
+			}
+			n = n.child(&n.wildcard, seg[1:len(seg)-4], pattern)
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+			n = n.child(&n.param, seg[1:len(seg)-1], pattern)
+		default:
+			if n.static == nil {
+				n.static = make(map[string]*routeNode)
+			}
+			if n.static[seg] == nil {
+				n.static[seg] = &routeNode{}
+			}
+			n = n.static[seg]
+		}
+	}
+	if n.serves == nil {
+		n.serves = make(map[string]ServeFunc)
+	}
+	if n.serves[method] != nil {
+		panic("wuppo: pattern " + pattern + " already registered for method '" + method + "'")
+	}
+	n.serves[method] = rt.wrap(serve)
+}
+
+// wrap wraps serve with the middlewares of rt and its parents. Middlewares
+// are looked up when the request is served, so that calls to Use affect
+// ServeFuncs that were registered earlier.
+func (rt *Router) wrap(serve ServeFunc) ServeFunc {
+	return func(req Req) {
+		s := serve
+		for g := rt; g != nil; g = g.parent {
+			s = Chain(s, g.middlewares...)
+		}
+		s(req)
+	}
+}
+
+// Get registers a ServeFunc for GET (and HEAD) requests.
+func (rt *Router) Get(pattern string, serve ServeFunc) {
+	rt.Handle(http.MethodGet, pattern, serve)
+}
+
+// Post registers a ServeFunc for POST requests.
+func (rt *Router) Post(pattern string, serve ServeFunc) {
+	rt.Handle(http.MethodPost, pattern, serve)
+}
+
+// Put registers a ServeFunc for PUT requests.
+func (rt *Router) Put(pattern string, serve ServeFunc) {
+	rt.Handle(http.MethodPut, pattern, serve)
+}
+
+// Delete registers a ServeFunc for DELETE requests.
+func (rt *Router) Delete(pattern string, serve ServeFunc) {
+	rt.Handle(http.MethodDelete, pattern, serve)
+}
+
+// Any registers a ServeFunc for all request methods.
+func (rt *Router) Any(pattern string, serve ServeFunc) {
+	rt.Handle("", pattern, serve)
+}
+
+// Serve is a ServeFunc that dispatches the request to the ServeFunc
+// registered for the request method and path.
+func (rt *Router) Serve(req Req) {
+	if rt.parent != nil {
+		rt.parent.Serve(req)
+		return
+	}
+	path := req.Path()
+	params := make(map[string]string)
+	n := rt.root.match(splitPath(path), params)
+	if n == nil {
+		if rt.RedirectTrailingSlash && path != "/" {
+			alt := path + "/"
+			if strings.HasSuffix(path, "/") {
+				alt = strings.TrimSuffix(path, "/")
+			}
+			if rt.root.match(splitPath(alt), make(map[string]string)) != nil {
+				// 308 keeps the method and body of other requests
+				code := http.StatusPermanentRedirect
+				if req.Method() == "GET" || req.Method() == "HEAD" {
+					code = http.StatusMovedPermanently
+				}
+				if q, ok := req.(rawQueryGetter); ok && q.rawQuery() != "" {
+					alt += "?" + q.rawQuery()
+				}
+				req.SetRedirectStatus(code, alt)
+				return
+			}
+		}
+		Chain(rt.notFound, rt.middlewares...)(req)
+		return
+	}
+	serve := n.lookup(req.Method())
+	if serve == nil {
+		Chain(rt.methodNotAllowed, rt.middlewares...)(req)
+		return
+	}
+	if p, ok := req.(pathParamSetter); ok {
+		p.setPathParams(params)
+	}
+	serve(req)
+}
+
+func (rt *Router) notFound(req Req) {
+	if rt.NotFound != nil {
+		rt.NotFound(req)
+	} else {
+		req.SetStatus(http.StatusNotFound)
+	}
+}
+
+func (rt *Router) methodNotAllowed(req Req) {
+	if rt.MethodNotAllowed != nil {
+		rt.MethodNotAllowed(req)
+	} else {
+		req.SetStatus(http.StatusMethodNotAllowed)
+	}
+}
+
+// pathParamSetter is implemented by Req implementations that can
+// receive the path parameters matched by a Router.
+type pathParamSetter interface {
+	setPathParams(params map[string]string)
+}
+
+// rawQueryGetter is implemented by Req implementations that know the raw
+// query string of the request, which the Router keeps in redirects.
+type rawQueryGetter interface {
+	rawQuery() string
+}
+
+// routeNode is a node in the Router's segment tree.
+type routeNode struct {
+	name     string // parameter name, for param and wildcard nodes
+	static   map[string]*routeNode
+	param    *routeNode
+	wildcard *routeNode
+	serves   map[string]ServeFunc // keyed by method, "" means any method
+}
+
+// child returns the param or wildcard child stored in *slot, creating it
+// if needed. It panics if the child exists with a different name.
+func (n *routeNode) child(slot **routeNode, name string, pattern string) *routeNode {
+	if name == "" {
+		panic("wuppo: empty parameter name in pattern " + pattern)
+	}
+	if *slot == nil {
+		*slot = &routeNode{name: name}
+	} else if (*slot).name != name {
+		panic("wuppo: parameter {" + name + "} in pattern " + pattern + " conflicts with {" + (*slot).name + "}")
+	}
+	return *slot
+}
+
+// match returns the node that matches segs, or nil if there is none. The
+// values of matched parameters are stored in params.
+func (n *routeNode) match(segs []string, params map[string]string) *routeNode {
+	if len(segs) == 0 {
+		if len(n.serves) > 0 {
+			return n
+		}
+		return nil
+	}
+	seg := segs[0]
+	if child := n.static[seg]; child != nil {
+		if m := child.match(segs[1:], params); m != nil {
+			return m
+		}
+	}
+	if n.param != nil && seg != "" {
+		if m := n.param.match(segs[1:], params); m != nil {
+			params[n.param.name] = seg
+			return m
+		}
+	}
+	if n.wildcard != nil && len(n.wildcard.serves) > 0 {
+		params[n.wildcard.name] = strings.Join(segs, "/")
+		return n.wildcard
+	}
+	return nil
+}
+
+// lookup returns the ServeFunc for a request method, or nil.
+func (n *routeNode) lookup(method string) ServeFunc {
+	if serve := n.serves[method]; serve != nil {
+		return serve
+	}
+	if method == http.MethodHead {
+		if serve := n.serves[http.MethodGet]; serve != nil {
+			return serve
+		}
+	}
+	return n.serves[""]
+}
+
+// splitPath splits a path into its segments. A trailing slash yields an
+// empty last segment, so "/" is [""] and "/a/" is ["a", ""].
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
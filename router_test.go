@@ -0,0 +1,141 @@
+package wuppo
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouterParams(t *testing.T) {
+	router := NewRouter()
+	var got string
+	router.Get("/users/{id}/posts/{slug}", func(req Req) {
+		got = req.PathParam("id") + "/" + req.PathParam("slug")
+	})
+	req := NewReqStub("GET", "/users/42/posts/hello")
+	router.Serve(req)
+	if got != "42/hello" {
+		t.Errorf("wanted 42/hello but was %q", got)
+	}
+	if req.PathParam("id") != "42" {
+		t.Errorf("wanted id 42 but was %q", req.PathParam("id"))
+	}
+}
+
+func TestRouterPrecedence(t *testing.T) {
+	router := NewRouter()
+	var got string
+	router.Get("/users/me", func(req Req) { got = "static" })
+	router.Get("/users/{id}", func(req Req) { got = "param" })
+	router.Get("/users/{rest...}", func(req Req) { got = "wildcard " + req.PathParam("rest") })
+	tests := map[string]string{
+		"/users/me":    "static",
+		"/users/42":    "param",
+		"/users/42/x":  "wildcard 42/x",
+		"/users/me/x/": "wildcard me/x/",
+	}
+	for path, want := range tests {
+		got = ""
+		router.Serve(NewReqStub("GET", path))
+		if got != want {
+			t.Errorf("%s: wanted %q but was %q", path, want, got)
+		}
+	}
+}
+
+func TestRouterMethods(t *testing.T) {
+	router := NewRouter()
+	var got string
+	router.Get("/form", func(req Req) { got = "get" })
+	router.Post("/form", func(req Req) { got = "post" })
+	router.Serve(NewReqStub("HEAD", "/form"))
+	if got != "get" {
+		t.Errorf("wanted get but was %q", got)
+	}
+	router.Serve(NewReqStub("POST", "/form"))
+	if got != "post" {
+		t.Errorf("wanted post but was %q", got)
+	}
+	req := NewReqStub("DELETE", "/form")
+	router.Serve(req)
+	if req.Status != 405 {
+		t.Errorf("wanted 405 but was %d", req.Status)
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router := NewRouter()
+	router.Get("/dir/", func(req Req) {})
+	router.Get("/file", func(req Req) {})
+	req := NewReqStub("GET", "/nothing")
+	router.Serve(req)
+	if req.Status != 404 {
+		t.Errorf("wanted 404 but was %d", req.Status)
+	}
+	req = NewReqStub("GET", "/dir")
+	router.Serve(req)
+	if req.Redirect != "/dir/" || req.Status != 301 {
+		t.Errorf("wanted 301 redirect to /dir/ but was %d %q", req.Status, req.Redirect)
+	}
+	req = NewReqStub("GET", "/file/")
+	router.Serve(req)
+	if req.Redirect != "/file" {
+		t.Errorf("wanted redirect to /file but was %q", req.Redirect)
+	}
+	req = NewReqStub("GET", "/dir")
+	req.RawQueryString = "q=1&page=2"
+	router.Serve(req)
+	if req.Redirect != "/dir/?q=1&page=2" {
+		t.Errorf("wanted redirect with query but was %q", req.Redirect)
+	}
+	req = NewReqStub("POST", "/dir")
+	router.Serve(req)
+	if req.Redirect != "/dir/" || req.Status != 308 {
+		t.Errorf("wanted 308 redirect to /dir/ but was %d %q", req.Status, req.Redirect)
+	}
+}
+
+func TestRouterRedirectKeepsQuery(t *testing.T) {
+	router := NewRouter()
+	router.Get("/dir/", func(req Req) {})
+	h, err := New(router.Serve, WithTemplatePattern(""), WithoutDefaultMiddleware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/dir?q=1", nil))
+	if loc := w.Header().Get("Location"); w.Code != 301 || loc != "/dir/?q=1" {
+		t.Errorf("wanted 301 to /dir/?q=1 but was %d %q", w.Code, loc)
+	}
+}
+
+func TestRouterGroupMiddleware(t *testing.T) {
+	router := NewRouter()
+	var trace []string
+	mw := func(name string) Middleware {
+		return func(next ServeFunc) ServeFunc {
+			return func(req Req) {
+				trace = append(trace, name)
+				next(req)
+			}
+		}
+	}
+	router.Use(mw("root"))
+	admin := router.Group("/admin")
+	admin.Get("/users", func(req Req) { trace = append(trace, "users") })
+	admin.Use(mw("admin"))
+	router.Serve(NewReqStub("GET", "/admin/users"))
+	if got := strings.Join(trace, ","); got != "root,admin,users" {
+		t.Errorf("wanted root,admin,users but was %s", got)
+	}
+	// short-circuit
+	admin.Use(func(next ServeFunc) ServeFunc {
+		return func(req Req) { req.SetStatus(403) }
+	})
+	req := NewReqStub("GET", "/admin/users")
+	router.Serve(req)
+	if req.Status != 403 {
+		t.Errorf("wanted 403 but was %d", req.Status)
+	}
+}
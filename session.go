@@ -1,16 +1,20 @@
 package wuppo
 
 import (
+	"container/heap"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"sort"
 	"sync"
 	"time"
 )
 
 // A SessionStore is used to manage HTTP sessions.
 type SessionStore interface {
-	// ExpireSessions expires old sessions. A session is old if it was
-	// not accessed within the last 30 minutes.
+	// ExpireSessions expires old sessions. A session is old if it was not
+	// accessed within the idle timeout of the store, or if it is older
+	// than the maximum lifetime of the store.
 	ExpireSessions()
 
 	// TouchSession sets the atime (last access time) of a session to the
@@ -34,32 +38,238 @@ type SessionStore interface {
 	GetSessionInfos() map[string]map[string]interface{}
 }
 
+// A LifetimeStore is a SessionStore that supports lifetimes per session,
+// for instance a "remember me" session that lasts 30 days.
+type LifetimeStore interface {
+	SessionStore
+
+	// SetSessionLifetime overrides the idle timeout and the maximum
+	// lifetime of a session. A zero duration keeps the default of the
+	// store. A session with overrides is persistent: its cookie survives
+	// browser restarts until the session expires.
+	SetSessionLifetime(sid string, idleTimeout time.Duration, maxLifetime time.Duration)
+
+	// SessionExpiry returns the time at which a session expires if it is
+	// not accessed before, and whether the session is persistent. If the
+	// session does not exist, it returns the zero time.
+	SessionExpiry(sid string) (expiry time.Time, persistent bool)
+
+	// TouchSessionExpiry touches a session like TouchSession and returns
+	// its new expiry like SessionExpiry, in one access to the store. The
+	// Handler calls it for every request with a session cookie.
+	TouchSessionExpiry(sid string) (expiry time.Time, persistent bool)
+}
+
+// A RenameStore is a SessionStore that can move a session to a new id,
+// which protects against session fixation: an attacker who planted a
+// session id in the browser of a victim cannot use it after the victim
+// logged in.
+type RenameStore interface {
+	SessionStore
+
+	// RenameSession moves the data of a session to a new random session
+	// id and removes the old id, in one step. It returns the new id, or
+	// the empty string if the session does not exist.
+	RenameSession(sid string) string
+}
+
+// A KeyStore is a SessionStore that can delete single session values and
+// list the keys of a session. All stores of this package are KeyStores,
+// except CookieStore, which is a RequestStore whose sessions are
+// KeyStores. For other stores, Req.SessionKeys and Req.ClearSession find
+// the keys of a session with GetSessionInfos, which reads all sessions.
+type KeyStore interface {
+	SessionStore
+
+	// DeleteValue removes a value from a session. It does nothing if the
+	// session or the key does not exist.
+	DeleteValue(sid string, key string)
+
+	// GetKeys returns the sorted keys of a session, or nil if the session
+	// does not exist.
+	GetKeys(sid string) []string
+}
+
+// A RequestStore is a SessionStore that loads the session of a request
+// once and writes it back at the end of the request, for instance into
+// the session cookie, like CookieStore does.
+//
+// The Handler calls LoadSession with the value of the session cookie
+// before the request is served, and uses the returned RequestSession for
+// all session access of the request. After the request was served, it
+// calls Commit and writes the session cookie if it has changed.
+type RequestStore interface {
+	SessionStore
+
+	// LoadSession returns the session of a request with a session cookie
+	// value, which is empty if the request has no session cookie.
+	LoadSession(value string) RequestSession
+}
+
+// A RequestSession is the session of one request, loaded by a
+// RequestStore. It is a store that holds at most one session, whose id
+// is the cookie value it was loaded with, or the id that PutValue
+// returns for a new session. It is only used by one request at a time.
+type RequestSession interface {
+	LifetimeStore
+	RenameStore
+	KeyStore
+
+	// Commit returns the new value of the session cookie, and whether
+	// the cookie must be written. An empty value deletes the cookie.
+	Commit() (value string, changed bool, err error)
+}
+
 // MemStore is a SessionStore that stores HTTP session data in memory.
 // If the process ends, all session data will be lost.
+//
+// Sessions are kept in a queue ordered by expiry time, so ExpireSessions
+// only looks at sessions that are due. A session that was accessed after
+// it was queued is put back with its new expiry time.
 type MemStore struct {
-	mx       sync.Mutex
-	sessions map[string]*session
+	mx          sync.RWMutex
+	sessions    map[string]*session
+	queue       expiryQueue
+	idleTimeout time.Duration
+	maxLifetime time.Duration
 }
 
 // NewMemStore creates a new MemStore.
 func NewMemStore() *MemStore {
 	st := &MemStore{
-		sessions: make(map[string]*session),
+		sessions:    make(map[string]*session),
+		idleTimeout: 30 * time.Minute,
 	}
 	return st
 }
 
-// ExpireSessions expires old sessions. A session is old if it was
-// not accessed within the last 30 minutes.
+// SetIdleTimeout sets the time after which a session expires if it is not
+// accessed. The default is 30 minutes.
+func (st *MemStore) SetIdleTimeout(d time.Duration) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.idleTimeout = d
+	st.queue = nil // expiry times have changed, rebuild queue
+}
+
+// SetMaxLifetime sets the time after which a session expires, no matter
+// how often it is accessed. The default is 0, which means no maximum.
+func (st *MemStore) SetMaxLifetime(d time.Duration) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.maxLifetime = d
+	st.queue = nil // expiry times have changed, rebuild queue
+}
+
+// SetSessionLifetime overrides the idle timeout and the maximum lifetime
+// of a session. A zero duration keeps the default of the store.
+func (st *MemStore) SetSessionLifetime(sid string, idleTimeout time.Duration, maxLifetime time.Duration) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	s := st.lookup(sid)
+	if s != nil {
+		s.idleTimeout = idleTimeout
+		s.maxLifetime = maxLifetime
+		s.persistent = true
+		if st.queue.contains(s) {
+			s.qexpiry = st.expiry(s)
+			heap.Fix(&st.queue, s.qindex)
+		}
+	}
+}
+
+// SessionExpiry returns the time at which a session expires if it is not
+// accessed before, and whether the session is persistent. If the session
+// does not exist, it returns the zero time.
+func (st *MemStore) SessionExpiry(sid string) (time.Time, bool) {
+	st.mx.RLock()
+	defer st.mx.RUnlock()
+	s := st.sessions[sid]
+	if !st.alive(s) {
+		return time.Time{}, false
+	}
+	return st.expiry(s), s.persistent
+}
+
+// errCorruptSession is the error of stored sessions that cannot be
+// decoded, for instance after a codec change. Stores treat such sessions
+// as missing and remove them.
+var errCorruptSession = errors.New("wuppo: cannot decode session")
+
+// expiryOf returns the time at which a session expires that was created
+// at ctime and last accessed at atime. The idle timeout and maximum
+// lifetime of the session override those of its store if they are not
+// zero. A zero maximum lifetime means no maximum. All session stores
+// expire sessions by this rule.
+func expiryOf(ctime, atime time.Time, idle, max, sessionIdle, sessionMax time.Duration) time.Time {
+	if sessionIdle > 0 {
+		idle = sessionIdle
+	}
+	if sessionMax > 0 {
+		max = sessionMax
+	}
+	expiry := atime.Add(idle)
+	if max > 0 && ctime.Add(max).Before(expiry) {
+		expiry = ctime.Add(max)
+	}
+	return expiry
+}
+
+// expiry returns the time at which a session expires.
+func (st *MemStore) expiry(s *session) time.Time {
+	return expiryOf(s.ctime, s.atime, st.idleTimeout, st.maxLifetime, s.idleTimeout, s.maxLifetime)
+}
+
+// alive returns true if s is a session that has not expired.
+func (st *MemStore) alive(s *session) bool {
+	return s != nil && !time.Now().After(st.expiry(s))
+}
+
+// lookup returns a session, or nil if the session does not exist or has
+// expired. Expired sessions are removed, so the write lock must be held.
+func (st *MemStore) lookup(sid string) *session {
+	s := st.sessions[sid]
+	if s != nil && !st.alive(s) {
+		st.remove(s)
+		return nil
+	}
+	return s
+}
+
+// remove removes a session from the map and the queue.
+func (st *MemStore) remove(s *session) {
+	delete(st.sessions, s.sid)
+	if st.queue.contains(s) {
+		heap.Remove(&st.queue, s.qindex)
+	}
+}
+
+// ExpireSessions expires old sessions. A session is old if it was not
+// accessed within the idle timeout (30 minutes by default), or if it is
+// older than the maximum lifetime (none by default).
 func (st *MemStore) ExpireSessions() {
 	st.mx.Lock()
 	defer st.mx.Unlock()
+	if len(st.queue) != len(st.sessions) {
+		// settings have changed or sessions were added from outside
+		st.queue = st.queue[:0]
+		for _, s := range st.sessions {
+			s.qexpiry = st.expiry(s)
+			st.queue = append(st.queue, s)
+		}
+		heap.Init(&st.queue)
+	}
 	// expire old sessions
-	for sid := range st.sessions {
-		s := st.sessions[sid]
-		if time.Since(s.atime).Minutes() > 30 {
-			// fmt.Printf("session %s expired\n", sid)
-			delete(st.sessions, sid)
+	now := time.Now()
+	for len(st.queue) > 0 && now.After(st.queue[0].qexpiry) {
+		s := st.queue[0]
+		expiry := st.expiry(s)
+		if now.After(expiry) {
+			st.remove(s)
+		} else {
+			// accessed since it was queued
+			s.qexpiry = expiry
+			heap.Fix(&st.queue, 0)
 		}
 	}
 }
@@ -67,11 +277,56 @@ func (st *MemStore) ExpireSessions() {
 // TouchSession sets the atime (last access time) of a session to the
 // current time, much like the unix 'touch' command does with files.
 func (st *MemStore) TouchSession(sid string) {
+	st.TouchSessionExpiry(sid)
+}
+
+// TouchSessionExpiry touches a session and returns its new expiry, and
+// whether it is persistent. If the session does not exist, it returns the
+// zero time.
+func (st *MemStore) TouchSessionExpiry(sid string) (time.Time, bool) {
 	st.mx.Lock()
 	defer st.mx.Unlock()
-	s := st.sessions[sid]
+	s := st.lookup(sid)
+	if s == nil {
+		return time.Time{}, false
+	}
+	s.atime = time.Now()
+	return st.expiry(s), s.persistent
+}
+
+// RenameSession moves the data of a session to a new random session id
+// and removes the old id. It returns the new id, or the empty string if
+// the session does not exist.
+func (st *MemStore) RenameSession(sid string) string {
+	s := st.detach(sid)
+	if s == nil {
+		return ""
+	}
+	s.sid = newSessionID()
+	st.attach(s)
+	return s.sid
+}
+
+// detach removes a session and returns it, or nil if the session does not
+// exist.
+func (st *MemStore) detach(sid string) *session {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	s := st.lookup(sid)
 	if s != nil {
-		s.atime = time.Now()
+		st.remove(s)
+	}
+	return s
+}
+
+// attach adds a session that was detached.
+func (st *MemStore) attach(s *session) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.sessions[s.sid] = s
+	if len(st.queue) == len(st.sessions)-1 {
+		s.qexpiry = st.expiry(s)
+		heap.Push(&st.queue, s)
 	}
 }
 
@@ -79,7 +334,9 @@ func (st *MemStore) TouchSession(sid string) {
 func (st *MemStore) KillSession(sid string) {
 	st.mx.Lock()
 	defer st.mx.Unlock()
-	delete(st.sessions, sid)
+	if s := st.sessions[sid]; s != nil {
+		st.remove(s)
+	}
 }
 
 // PutValue puts a value into a session and returns the session id.
@@ -88,48 +345,96 @@ func (st *MemStore) KillSession(sid string) {
 func (st *MemStore) PutValue(sid string, key string, value interface{}) string {
 	st.mx.Lock()
 	defer st.mx.Unlock()
-	s := st.sessions[sid]
+	s := st.lookup(sid)
 	if s == nil {
 		// fmt.Printf("session %s not found\n", sid)
-		buf := make([]byte, 16)
-		if _, err := rand.Read(buf); err != nil {
-			panic(err)
-		}
-		s = &session{
-			sid:    hex.EncodeToString(buf),
-			atime:  time.Now(),
-			values: make(map[string]interface{}),
-		}
-		st.sessions[s.sid] = s
+		s = st.create(newSessionID())
 		// fmt.Printf("created new session %s\n", s.sid)
 	}
 	s.values[key] = value
 	return s.sid
 }
 
+// putValue puts a value into the session sid. If the session does not
+// exist, putValue creates it if create is true, or returns false otherwise.
+func (st *MemStore) putValue(sid string, key string, value interface{}, create bool) bool {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	s := st.lookup(sid)
+	if s == nil {
+		if !create {
+			return false
+		}
+		s = st.create(sid)
+	}
+	s.values[key] = value
+	return true
+}
+
+// create creates a new session and queues it. The write lock must be held.
+func (st *MemStore) create(sid string) *session {
+	now := time.Now()
+	s := &session{
+		sid:    sid,
+		ctime:  now,
+		atime:  now,
+		values: make(map[string]interface{}),
+	}
+	st.sessions[s.sid] = s
+	if len(st.queue) == len(st.sessions)-1 {
+		s.qexpiry = st.expiry(s)
+		heap.Push(&st.queue, s)
+	}
+	return s
+}
+
 // GetValue returns a session value. If the session or the key does not
 // exist, it returns nil.
 func (st *MemStore) GetValue(sid string, key string) interface{} {
+	st.mx.RLock()
+	defer st.mx.RUnlock()
+	s := st.sessions[sid]
+	if !st.alive(s) {
+		return nil
+	}
+	return s.values[key]
+}
+
+// DeleteValue removes a value from a session. It does nothing if the
+// session or the key does not exist.
+func (st *MemStore) DeleteValue(sid string, key string) {
 	st.mx.Lock()
 	defer st.mx.Unlock()
+	if s := st.lookup(sid); s != nil {
+		delete(s.values, key)
+	}
+}
+
+// GetKeys returns the sorted keys of a session, or nil if the session
+// does not exist.
+func (st *MemStore) GetKeys(sid string) []string {
+	st.mx.RLock()
+	defer st.mx.RUnlock()
 	s := st.sessions[sid]
-	if s == nil {
+	if !st.alive(s) {
 		return nil
 	}
-	return s.values[key]
+	return sortedKeys(s.values)
 }
 
 // GetSessionInfos returns map of maps containg all sessions with
 // their key/value pairs.
 func (st *MemStore) GetSessionInfos() map[string]map[string]interface{} {
-	st.mx.Lock()
-	defer st.mx.Unlock()
+	st.mx.RLock()
+	defer st.mx.RUnlock()
 	infos := make(map[string]map[string]interface{})
 	for sid := range st.sessions {
 		s := st.sessions[sid]
 		infos[sid] = make(map[string]interface{})
 		infos[sid]["_sid"] = sid
+		infos[sid]["_ctime"] = s.ctime.String()
 		infos[sid]["_atime"] = s.atime.String()
+		infos[sid]["_expires"] = st.expiry(s).String()
 		for key := range s.values {
 			infos[sid][key] = s.values[key]
 		}
@@ -137,10 +442,67 @@ func (st *MemStore) GetSessionInfos() map[string]map[string]interface{} {
 	return infos
 }
 
+// newSessionID returns a new random session id.
+func newSessionID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// sortedKeys returns the sorted keys of session values.
+func sortedKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 type session struct {
-	sid    string
-	atime  time.Time
-	values map[string]interface{}
+	sid         string
+	ctime       time.Time
+	atime       time.Time
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	persistent  bool
+	values      map[string]interface{}
+	qindex      int       // index in the expiry queue
+	qexpiry     time.Time // expiry time when the session was queued
+}
+
+// expiryQueue is a min-heap of sessions, ordered by queued expiry time.
+// It implements heap.Interface.
+type expiryQueue []*session
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].qexpiry.Before(q[j].qexpiry) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].qindex = i
+	q[j].qindex = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	s := x.(*session)
+	s.qindex = len(*q)
+	*q = append(*q, s)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	s := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return s
+}
+
+// contains returns true if s is in the queue.
+func (q expiryQueue) contains(s *session) bool {
+	return s.qindex < len(q) && q[s.qindex] == s
 }
 
 // eof
@@ -1,6 +1,8 @@
 package wuppo
 
 import (
+	"math/rand"
+	"sync"
 	"testing"
 	"time"
 )
@@ -97,3 +99,293 @@ func TestGetValue(t *testing.T) {
 		t.Errorf("wanted nil")
 	}
 }
+
+func TestSessionLifetime(t *testing.T) {
+	store := NewMemStore()
+	store.SetIdleTimeout(10 * time.Minute)
+	store.SetMaxLifetime(time.Hour)
+	now := time.Now()
+	store.sessions["young"] = &session{
+		sid:    "young",
+		ctime:  now.Add(-30 * time.Minute),
+		atime:  now.Add(-5 * time.Minute),
+		values: make(map[string]interface{}),
+	}
+	store.sessions["idle"] = &session{
+		sid:    "idle",
+		ctime:  now.Add(-30 * time.Minute),
+		atime:  now.Add(-15 * time.Minute),
+		values: make(map[string]interface{}),
+	}
+	store.sessions["old"] = &session{
+		sid:    "old",
+		ctime:  now.Add(-61 * time.Minute),
+		atime:  now,
+		values: make(map[string]interface{}),
+	}
+	store.sessions["remembered"] = &session{
+		sid:         "remembered",
+		ctime:       now.Add(-2 * time.Hour),
+		atime:       now.Add(-15 * time.Minute),
+		idleTimeout: 24 * time.Hour,
+		maxLifetime: 30 * 24 * time.Hour,
+		persistent:  true,
+		values:      make(map[string]interface{}),
+	}
+	store.ExpireSessions()
+	if len(store.sessions) != 2 {
+		t.Error("expected 2 sessions to survive but have", len(store.sessions))
+	}
+	expiry, persistent := store.SessionExpiry("remembered")
+	if !persistent || expiry.Sub(now) < 23*time.Hour {
+		t.Errorf("wrong expiry %s / %t", expiry, persistent)
+	}
+	expiry, persistent = store.SessionExpiry("young")
+	if persistent || expiry.Sub(now) > 5*time.Minute {
+		t.Errorf("wrong expiry %s / %t", expiry, persistent)
+	}
+	if _, ok := store.GetSessionInfos()["young"]["_expires"]; !ok {
+		t.Errorf("wanted _expires in session infos")
+	}
+}
+
+func TestExpiryQueue(t *testing.T) {
+	store := NewMemStore()
+	store.SetIdleTimeout(time.Hour)
+	sid1 := store.PutValue("", "name", "chris")
+	sid2 := store.PutValue("", "name", "bi")
+	sid3 := store.PutValue("", "name", "cv")
+	store.KillSession(sid3)
+	if len(store.queue) != 2 {
+		t.Fatalf("expected 2 queued sessions but have %d", len(store.queue))
+	}
+	// sid1 was accessed recently, sid2 is overdue
+	store.sessions[sid1].qexpiry = time.Now().Add(-time.Minute)
+	store.sessions[sid2].qexpiry = time.Now().Add(-time.Minute)
+	store.sessions[sid2].atime = time.Now().Add(-2 * time.Hour)
+	store.ExpireSessions()
+	if len(store.sessions) != 1 || store.sessions[sid1] == nil {
+		t.Fatalf("expected sid1 to survive")
+	}
+	if len(store.queue) != 1 || store.queue[0].qexpiry.Before(time.Now()) {
+		t.Errorf("expected sid1 to be requeued")
+	}
+	// expired sessions are gone even before ExpireSessions runs
+	store.sessions[sid1].atime = time.Now().Add(-2 * time.Hour)
+	if store.GetValue(sid1, "name") != nil {
+		t.Errorf("wanted nil")
+	}
+}
+
+func TestShardedStore(t *testing.T) {
+	store := NewShardedStore(8)
+	sids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		sid := store.PutValue("", "i", i)
+		if store.shard(sid).GetValue(sid, "i") != i {
+			t.Fatalf("session %s not in its shard", sid)
+		}
+		sids[sid] = true
+	}
+	if len(sids) != 100 || len(store.GetSessionInfos()) != 100 {
+		t.Fatalf("expected 100 sessions")
+	}
+	used := 0
+	for _, sh := range store.shards {
+		if len(sh.sessions) > 0 {
+			used++
+		}
+	}
+	if used < 4 {
+		t.Errorf("expected sessions to be spread over shards, but only %d were used", used)
+	}
+	for sid := range sids {
+		if store.PutValue(sid, "name", "chris") != sid {
+			t.Errorf("expected same sid")
+		}
+		store.KillSession(sid)
+		if store.GetValue(sid, "name") != nil {
+			t.Errorf("wanted nil")
+		}
+	}
+}
+
+func TestRenameSession(t *testing.T) {
+	for _, store := range []RenameStore{NewMemStore(), NewShardedStore(8)} {
+		sid := store.PutValue("", "name", "chris")
+		newSid := store.RenameSession(sid)
+		if len(newSid) != 32 || newSid == sid {
+			t.Fatalf("%T: wanted new sid but was %q", store, newSid)
+		}
+		if store.GetValue(sid, "name") != nil {
+			t.Errorf("%T: wanted old sid to be removed", store)
+		}
+		if v := store.GetValue(newSid, "name"); v != "chris" {
+			t.Errorf("%T: wanted chris but was %v", store, v)
+		}
+		if store.PutValue(newSid, "age", 42) != newSid {
+			t.Errorf("%T: wanted renamed session to be usable", store)
+		}
+		if store.RenameSession("unknown") != "" {
+			t.Errorf("%T: wanted empty sid for unknown session", store)
+		}
+	}
+}
+
+func TestExpiryOf(t *testing.T) {
+	ctime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	atime := ctime.Add(time.Hour)
+	for _, tc := range []struct {
+		idle, max, sessionIdle, sessionMax time.Duration
+		want                               time.Duration // after ctime
+	}{
+		{30 * time.Minute, 0, 0, 0, 90 * time.Minute},
+		{30 * time.Minute, 80 * time.Minute, 0, 0, 80 * time.Minute},
+		{30 * time.Minute, 2 * time.Hour, 0, 0, 90 * time.Minute},
+		{30 * time.Minute, 80 * time.Minute, 24 * time.Hour, 0, 80 * time.Minute},
+		{30 * time.Minute, 80 * time.Minute, 24 * time.Hour, 48 * time.Hour, 25 * time.Hour},
+		{30 * time.Minute, 0, 10 * time.Minute, 0, 70 * time.Minute},
+	} {
+		if got := expiryOf(ctime, atime, tc.idle, tc.max, tc.sessionIdle, tc.sessionMax).Sub(ctime); got != tc.want {
+			t.Errorf("%v: wanted %v but was %v", tc, tc.want, got)
+		}
+	}
+}
+
+func TestKeyStores(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStore.Close()
+	db, _ := openMemDB(t)
+	sqlStore := NewSQLStore(db, "", nil)
+	sqlStore.Migrate()
+	redisStore := NewRedisStore(newRespServer(t, "").addr(), nil)
+	defer redisStore.Close()
+	for _, store := range []KeyStore{NewMemStore(), NewShardedStore(4), fileStore, sqlStore, redisStore} {
+		sid := store.PutValue("", "b", 1)
+		store.PutValue(sid, "a", 2)
+		if keys := store.GetKeys(sid); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+			t.Errorf("%T: wrong keys %v", store, keys)
+		}
+		store.DeleteValue(sid, "a")
+		store.DeleteValue(sid, "unknown")
+		if keys := store.GetKeys(sid); len(keys) != 1 || keys[0] != "b" {
+			t.Errorf("%T: wrong keys after delete %v", store, keys)
+		}
+		if store.GetValue(sid, "a") != nil {
+			t.Errorf("%T: wanted deleted value", store)
+		}
+		if keys := store.GetKeys("unknown"); keys != nil {
+			t.Errorf("%T: wanted nil keys but was %v", store, keys)
+		}
+	}
+}
+
+func TestTouchSessionExpiry(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStore.Close()
+	db, _ := openMemDB(t)
+	sqlStore := NewSQLStore(db, "", nil)
+	sqlStore.Migrate()
+	redisStore := NewRedisStore(newRespServer(t, "").addr(), nil)
+	defer redisStore.Close()
+	for _, store := range []LifetimeStore{NewMemStore(), NewShardedStore(4), fileStore, sqlStore, redisStore} {
+		sid := store.PutValue("", "name", "chris")
+		expiry, persistent := store.TouchSessionExpiry(sid)
+		if persistent || time.Until(expiry) < 29*time.Minute {
+			t.Errorf("%T: wrong expiry %v %v", store, expiry, persistent)
+		}
+		store.SetSessionLifetime(sid, 24*time.Hour, 0)
+		expiry, persistent = store.TouchSessionExpiry(sid)
+		if !persistent || time.Until(expiry) < 23*time.Hour {
+			t.Errorf("%T: wrong persistent expiry %v %v", store, expiry, persistent)
+		}
+		if expiry, _ := store.TouchSessionExpiry("unknown"); !expiry.IsZero() {
+			t.Errorf("%T: wanted zero expiry but was %v", store, expiry)
+		}
+	}
+}
+
+// benchmarkStore runs a mix of session operations on many goroutines:
+// every request touches its session and reads a value, every tenth
+// request also writes a value.
+func benchmarkStore(b *testing.B, store SessionStore) {
+	sids := make([]string, 1000)
+	for i := range sids {
+		sids[i] = store.PutValue("", "name", "chris")
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Intn(len(sids))
+		for pb.Next() {
+			sid := sids[i%len(sids)]
+			store.TouchSession(sid)
+			store.GetValue(sid, "name")
+			if i%10 == 0 {
+				store.PutValue(sid, "count", i)
+			}
+			i++
+		}
+	})
+}
+
+// mutexStore serializes all calls to a store with one mutex, like the
+// MemStore did before it had a read/write lock. It is the baseline of the
+// parallel benchmarks.
+type mutexStore struct {
+	mx sync.Mutex
+	st SessionStore
+}
+
+func (ms *mutexStore) ExpireSessions() {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	ms.st.ExpireSessions()
+}
+
+func (ms *mutexStore) TouchSession(sid string) {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	ms.st.TouchSession(sid)
+}
+
+func (ms *mutexStore) KillSession(sid string) {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	ms.st.KillSession(sid)
+}
+
+func (ms *mutexStore) PutValue(sid string, key string, value interface{}) string {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	return ms.st.PutValue(sid, key, value)
+}
+
+func (ms *mutexStore) GetValue(sid string, key string) interface{} {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	return ms.st.GetValue(sid, key)
+}
+
+func (ms *mutexStore) GetSessionInfos() map[string]map[string]interface{} {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	return ms.st.GetSessionInfos()
+}
+
+func BenchmarkMutexStoreParallel(b *testing.B) {
+	benchmarkStore(b, &mutexStore{st: NewMemStore()})
+}
+
+func BenchmarkMemStoreParallel(b *testing.B) {
+	benchmarkStore(b, NewMemStore())
+}
+
+func BenchmarkShardedStoreParallel(b *testing.B) {
+	benchmarkStore(b, NewShardedStore(0))
+}
@@ -0,0 +1,157 @@
+package wuppo
+
+import (
+	"time"
+)
+
+// DefaultShardCount is the number of shards of a ShardedStore created
+// with a shard count of zero.
+const DefaultShardCount = 64
+
+// ShardedStore is a SessionStore that stores HTTP session data in memory,
+// like MemStore, but partitions the sessions into shards by a hash of the
+// session id. Each shard has its own read/write lock, so requests of
+// different sessions rarely wait for each other. Use it instead of
+// MemStore for servers with many concurrent requests.
+// If the process ends, all session data will be lost.
+type ShardedStore struct {
+	shards []*MemStore
+}
+
+// NewShardedStore creates a new ShardedStore with n shards. If n is zero
+// or less, it uses DefaultShardCount shards.
+func NewShardedStore(n int) *ShardedStore {
+	if n <= 0 {
+		n = DefaultShardCount
+	}
+	st := &ShardedStore{
+		shards: make([]*MemStore, n),
+	}
+	for i := range st.shards {
+		st.shards[i] = NewMemStore()
+	}
+	return st
+}
+
+// shard returns the shard of a session id. It hashes the id with 32-bit
+// FNV-1a, inlined to avoid allocations.
+func (st *ShardedStore) shard(sid string) *MemStore {
+	h := uint32(2166136261)
+	for i := 0; i < len(sid); i++ {
+		h ^= uint32(sid[i])
+		h *= 16777619
+	}
+	return st.shards[h%uint32(len(st.shards))]
+}
+
+// SetIdleTimeout sets the time after which a session expires if it is not
+// accessed. The default is 30 minutes.
+func (st *ShardedStore) SetIdleTimeout(d time.Duration) {
+	for _, sh := range st.shards {
+		sh.SetIdleTimeout(d)
+	}
+}
+
+// SetMaxLifetime sets the time after which a session expires, no matter
+// how often it is accessed. The default is 0, which means no maximum.
+func (st *ShardedStore) SetMaxLifetime(d time.Duration) {
+	for _, sh := range st.shards {
+		sh.SetMaxLifetime(d)
+	}
+}
+
+// SetSessionLifetime overrides the idle timeout and the maximum lifetime
+// of a session. A zero duration keeps the default of the store.
+func (st *ShardedStore) SetSessionLifetime(sid string, idleTimeout time.Duration, maxLifetime time.Duration) {
+	st.shard(sid).SetSessionLifetime(sid, idleTimeout, maxLifetime)
+}
+
+// SessionExpiry returns the time at which a session expires if it is not
+// accessed before, and whether the session is persistent. If the session
+// does not exist, it returns the zero time.
+func (st *ShardedStore) SessionExpiry(sid string) (time.Time, bool) {
+	return st.shard(sid).SessionExpiry(sid)
+}
+
+// ExpireSessions expires old sessions, one shard after the other. A
+// session is old if it was not accessed within the idle timeout (30
+// minutes by default), or if it is older than the maximum lifetime (none
+// by default).
+func (st *ShardedStore) ExpireSessions() {
+	for _, sh := range st.shards {
+		sh.ExpireSessions()
+	}
+}
+
+// TouchSession sets the atime (last access time) of a session to the
+// current time, much like the unix 'touch' command does with files.
+func (st *ShardedStore) TouchSession(sid string) {
+	st.shard(sid).TouchSession(sid)
+}
+
+// TouchSessionExpiry touches a session and returns its new expiry, and
+// whether it is persistent. If the session does not exist, it returns the
+// zero time.
+func (st *ShardedStore) TouchSessionExpiry(sid string) (time.Time, bool) {
+	return st.shard(sid).TouchSessionExpiry(sid)
+}
+
+// RenameSession moves the data of a session to a new random session id,
+// which may be in another shard, and removes the old id. It returns the
+// new id, or the empty string if the session does not exist.
+func (st *ShardedStore) RenameSession(sid string) string {
+	s := st.shard(sid).detach(sid)
+	if s == nil {
+		return ""
+	}
+	s.sid = newSessionID()
+	st.shard(s.sid).attach(s)
+	return s.sid
+}
+
+// KillSession removes a session.
+func (st *ShardedStore) KillSession(sid string) {
+	st.shard(sid).KillSession(sid)
+}
+
+// PutValue puts a value into a session and returns the session id.
+// If the session with the incoming session id was not found,
+// PutValue creates a new session and returns the new session id.
+func (st *ShardedStore) PutValue(sid string, key string, value interface{}) string {
+	if st.shard(sid).putValue(sid, key, value, false) {
+		return sid
+	}
+	newSid := newSessionID()
+	st.shard(newSid).putValue(newSid, key, value, true)
+	return newSid
+}
+
+// GetValue returns a session value. If the session or the key does not
+// exist, it returns nil.
+func (st *ShardedStore) GetValue(sid string, key string) interface{} {
+	return st.shard(sid).GetValue(sid, key)
+}
+
+// DeleteValue removes a value from a session. It does nothing if the
+// session or the key does not exist.
+func (st *ShardedStore) DeleteValue(sid string, key string) {
+	st.shard(sid).DeleteValue(sid, key)
+}
+
+// GetKeys returns the sorted keys of a session, or nil if the session
+// does not exist.
+func (st *ShardedStore) GetKeys(sid string) []string {
+	return st.shard(sid).GetKeys(sid)
+}
+
+// GetSessionInfos returns map of maps containg all sessions with
+// their key/value pairs.
+func (st *ShardedStore) GetSessionInfos() map[string]map[string]interface{} {
+	infos := make(map[string]map[string]interface{})
+	for _, sh := range st.shards {
+		for sid, info := range sh.GetSessionInfos() {
+			infos[sid] = info
+		}
+	}
+	return infos
+}
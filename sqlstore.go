@@ -0,0 +1,453 @@
+package wuppo
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLStore is a SessionStore that stores HTTP sessions in a SQL database
+// through database/sql, so sessions survive restarts and can be shared by
+// several instances of an application. It needs one table, which Migrate
+// creates; for a table named "wuppo_sessions" the schema is:
+//
+//	CREATE TABLE IF NOT EXISTS wuppo_sessions (
+//		sid          VARCHAR(64) NOT NULL PRIMARY KEY,
+//		ctime        BIGINT NOT NULL,
+//		atime        BIGINT NOT NULL,
+//		idle_timeout BIGINT NOT NULL,
+//		max_lifetime BIGINT NOT NULL,
+//		persistent   INTEGER NOT NULL,
+//		expires      BIGINT NOT NULL,
+//		version      BIGINT NOT NULL,
+//		data         TEXT NOT NULL
+//	);
+//	CREATE INDEX IF NOT EXISTS wuppo_sessions_expires ON wuppo_sessions (expires);
+//
+// Times are unix milliseconds, durations are milliseconds. The values of
+// a session are encoded together with a Codec and stored base64-encoded
+// in the data column; with GobCodec their types must be registered with
+// gob.Register (see GobCodec). The expires column holds the expiry time
+// of a session and is indexed, so ExpireSessions is a single DELETE.
+//
+// Updates are checked against the version column, so concurrent requests
+// of one session, even in different processes, do not overwrite each
+// other's values. Since SessionStore methods cannot return errors, they
+// panic on database errors, which the Handler turns into a 500 response.
+type SQLStore struct {
+	db          *sql.DB
+	table       string
+	codec       Codec
+	numbered    bool
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+}
+
+// sqlSession is a row of the session table.
+type sqlSession struct {
+	sid         string
+	ctime       time.Time
+	atime       time.Time
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	persistent  bool
+	version     int64
+	values      map[string]interface{}
+}
+
+// NewSQLStore creates a new SQLStore that stores sessions in table of db.
+// The table name is used in SQL statements as it is, so it must come from
+// a trusted source. If table is empty, it uses "wuppo_sessions". Values
+// are encoded with codec, if codec is nil, it uses GobCodec.
+func NewSQLStore(db *sql.DB, table string, codec Codec) *SQLStore {
+	if table == "" {
+		table = "wuppo_sessions"
+	}
+	if codec == nil {
+		codec = GobCodec
+	}
+	st := &SQLStore{
+		db:          db,
+		table:       table,
+		codec:       codec,
+		idleTimeout: 30 * time.Minute,
+	}
+	return st
+}
+
+// SetNumberedPlaceholders sets whether statements use numbered
+// placeholders like $1, as PostgreSQL does, instead of question marks.
+// The default is question marks.
+func (st *SQLStore) SetNumberedPlaceholders(numbered bool) {
+	st.numbered = numbered
+}
+
+// SetIdleTimeout sets the time after which a session expires if it is not
+// accessed. The default is 30 minutes.
+func (st *SQLStore) SetIdleTimeout(d time.Duration) {
+	st.idleTimeout = d
+}
+
+// SetMaxLifetime sets the time after which a session expires, no matter
+// how often it is accessed. The default is 0, which means no maximum.
+func (st *SQLStore) SetMaxLifetime(d time.Duration) {
+	st.maxLifetime = d
+}
+
+// Schema returns the statements that create the session table and its
+// index. They work with SQLite and PostgreSQL; MySQL does not know
+// CREATE INDEX IF NOT EXISTS, create the index once by hand there.
+func (st *SQLStore) Schema() []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + st.table + " (" +
+			"sid VARCHAR(64) NOT NULL PRIMARY KEY, " +
+			"ctime BIGINT NOT NULL, " +
+			"atime BIGINT NOT NULL, " +
+			"idle_timeout BIGINT NOT NULL, " +
+			"max_lifetime BIGINT NOT NULL, " +
+			"persistent INTEGER NOT NULL, " +
+			"expires BIGINT NOT NULL, " +
+			"version BIGINT NOT NULL, " +
+			"data TEXT NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS " + st.table + "_expires ON " + st.table + " (expires)",
+	}
+}
+
+// Migrate creates the session table and its index if they do not exist.
+func (st *SQLStore) Migrate() error {
+	for _, stmt := range st.Schema() {
+		if _, err := st.db.Exec(stmt); err != nil {
+			return fmt.Errorf("wuppo: cannot migrate session table: %w", err)
+		}
+	}
+	return nil
+}
+
+// query returns a statement with the table name filled in for "%s" and
+// the placeholders of the store.
+func (st *SQLStore) query(stmt string) string {
+	stmt = strings.ReplaceAll(stmt, "%s", st.table)
+	if !st.numbered {
+		return stmt
+	}
+	var sb strings.Builder
+	n := 0
+	for _, c := range stmt {
+		if c == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// exec executes a statement and returns the number of affected rows. It
+// panics on errors.
+func (st *SQLStore) exec(stmt string, args ...interface{}) int64 {
+	result, err := st.db.Exec(st.query(stmt), args...)
+	if err != nil {
+		panic(fmt.Errorf("wuppo: cannot update sessions: %w", err))
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		panic(fmt.Errorf("wuppo: cannot update sessions: %w", err))
+	}
+	return n
+}
+
+// expiry returns the time at which a session expires.
+func (st *SQLStore) expiry(s *sqlSession) time.Time {
+	return expiryOf(s.ctime, s.atime, st.idleTimeout, st.maxLifetime, s.idleTimeout, s.maxLifetime)
+}
+
+// scan reads a session from a row with the columns ctime, atime,
+// idle_timeout, max_lifetime, persistent, version and data. If the data
+// cannot be decoded, the error is an errCorruptSession.
+func (st *SQLStore) scan(row interface{ Scan(...interface{}) error }, s *sqlSession) error {
+	var ctime, atime, idle, max, persistent int64
+	var data string
+	if err := row.Scan(&ctime, &atime, &idle, &max, &persistent, &s.version, &data); err != nil {
+		return err
+	}
+	s.ctime = time.UnixMilli(ctime)
+	s.atime = time.UnixMilli(atime)
+	s.idleTimeout = time.Duration(idle) * time.Millisecond
+	s.maxLifetime = time.Duration(max) * time.Millisecond
+	s.persistent = persistent != 0
+	buf, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return fmt.Errorf("%w %s: %v", errCorruptSession, s.sid, err)
+	}
+	if err := st.codec.Unmarshal(buf, &s.values); err != nil {
+		return fmt.Errorf("%w %s: %v", errCorruptSession, s.sid, err)
+	}
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	return nil
+}
+
+// load returns a session that has not expired, or nil. A session that
+// cannot be decoded is removed and treated as missing, so it does not
+// fail every request that carries its cookie. It panics on other errors.
+func (st *SQLStore) load(sid string) *sqlSession {
+	s := &sqlSession{sid: sid}
+	row := st.db.QueryRow(st.query("SELECT ctime, atime, idle_timeout, max_lifetime, persistent, version, data FROM %s WHERE sid = ? AND expires > ?"),
+		sid, time.Now().UnixMilli())
+	if err := st.scan(row, s); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if errors.Is(err, errCorruptSession) {
+			st.KillSession(sid)
+			return nil
+		}
+		panic(fmt.Errorf("wuppo: cannot load session: %w", err))
+	}
+	return s
+}
+
+// encode encodes the values of a session for the data column.
+func (st *SQLStore) encode(s *sqlSession) string {
+	buf, err := st.codec.Marshal(s.values)
+	if err != nil {
+		panic(fmt.Errorf("wuppo: cannot encode session: %w", err))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// insert inserts a new session.
+func (st *SQLStore) insert(s *sqlSession) {
+	st.exec("INSERT INTO %s (sid, ctime, atime, idle_timeout, max_lifetime, persistent, expires, version, data) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		s.sid, s.ctime.UnixMilli(), s.atime.UnixMilli(), s.idleTimeout.Milliseconds(), s.maxLifetime.Milliseconds(),
+		boolInt(s.persistent), st.expiry(s).UnixMilli(), s.version, st.encode(s))
+}
+
+// update stores a loaded session if it was not changed since it was
+// loaded. It returns false if it was changed or removed.
+func (st *SQLStore) update(s *sqlSession) bool {
+	n := st.exec("UPDATE %s SET atime = ?, idle_timeout = ?, max_lifetime = ?, persistent = ?, expires = ?, version = ?, data = ? WHERE sid = ? AND version = ?",
+		s.atime.UnixMilli(), s.idleTimeout.Milliseconds(), s.maxLifetime.Milliseconds(), boolInt(s.persistent),
+		st.expiry(s).UnixMilli(), s.version+1, st.encode(s), s.sid, s.version)
+	return n == 1
+}
+
+// modify loads a session, applies fn to it and stores it, retrying if the
+// session was changed concurrently. It returns false if the session does
+// not exist.
+func (st *SQLStore) modify(sid string, fn func(s *sqlSession)) bool {
+	for {
+		s := st.load(sid)
+		if s == nil {
+			return false
+		}
+		fn(s)
+		if st.update(s) {
+			return true
+		}
+	}
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// SetSessionLifetime overrides the idle timeout and the maximum lifetime
+// of a session. A zero duration keeps the default of the store.
+func (st *SQLStore) SetSessionLifetime(sid string, idleTimeout time.Duration, maxLifetime time.Duration) {
+	st.modify(sid, func(s *sqlSession) {
+		s.idleTimeout = idleTimeout
+		s.maxLifetime = maxLifetime
+		s.persistent = true
+	})
+}
+
+// SessionExpiry returns the time at which a session expires if it is not
+// accessed before, and whether the session is persistent. If the session
+// does not exist, it returns the zero time.
+func (st *SQLStore) SessionExpiry(sid string) (time.Time, bool) {
+	s := st.load(sid)
+	if s == nil {
+		return time.Time{}, false
+	}
+	return st.expiry(s), s.persistent
+}
+
+// ExpireSessions removes old sessions with a single DELETE on the indexed
+// expires column. A session is old if it was not accessed within the idle
+// timeout (30 minutes by default), or if it is older than the maximum
+// lifetime (none by default). Errors are ignored, ExpireSessions runs
+// again in the next janitor interval.
+func (st *SQLStore) ExpireSessions() {
+	st.db.Exec(st.query("DELETE FROM %s WHERE expires <= ?"), time.Now().UnixMilli())
+}
+
+// TouchSession sets the atime (last access time) of a session to the
+// current time, much like the unix 'touch' command does with files.
+func (st *SQLStore) TouchSession(sid string) {
+	st.TouchSessionExpiry(sid)
+}
+
+// TouchSessionExpiry touches a session and returns its new expiry, and
+// whether it is persistent. If the session does not exist, it returns the
+// zero time.
+func (st *SQLStore) TouchSessionExpiry(sid string) (time.Time, bool) {
+	s := st.load(sid)
+	if s == nil {
+		return time.Time{}, false
+	}
+	s.atime = time.Now()
+	expiry := st.expiry(s)
+	st.exec("UPDATE %s SET atime = ?, expires = ? WHERE sid = ?", s.atime.UnixMilli(), expiry.UnixMilli(), sid)
+	return expiry, s.persistent
+}
+
+// RenameSession moves the data of a session to a new random session id
+// with a single UPDATE. It returns the new id, or the empty string if the
+// session does not exist.
+func (st *SQLStore) RenameSession(sid string) string {
+	newSid := newSessionID()
+	if st.exec("UPDATE %s SET sid = ? WHERE sid = ? AND expires > ?", newSid, sid, time.Now().UnixMilli()) != 1 {
+		return ""
+	}
+	return newSid
+}
+
+// KillSession removes a session.
+func (st *SQLStore) KillSession(sid string) {
+	st.exec("DELETE FROM %s WHERE sid = ?", sid)
+}
+
+// PutValue puts a value into a session and returns the session id.
+// If the session with the incoming session id was not found,
+// PutValue creates a new session and returns the new session id.
+func (st *SQLStore) PutValue(sid string, key string, value interface{}) string {
+	found := st.modify(sid, func(s *sqlSession) {
+		s.values[key] = value
+	})
+	if found {
+		return sid
+	}
+	now := time.Now()
+	s := &sqlSession{
+		sid:    newSessionID(),
+		ctime:  now,
+		atime:  now,
+		values: map[string]interface{}{key: value},
+	}
+	st.insert(s)
+	return s.sid
+}
+
+// GetValue returns a session value. If the session or the key does not
+// exist, it returns nil.
+func (st *SQLStore) GetValue(sid string, key string) interface{} {
+	s := st.load(sid)
+	if s == nil {
+		return nil
+	}
+	return s.values[key]
+}
+
+// DeleteValue removes a value from a session. It does nothing if the
+// session or the key does not exist.
+func (st *SQLStore) DeleteValue(sid string, key string) {
+	st.modify(sid, func(s *sqlSession) {
+		delete(s.values, key)
+	})
+}
+
+// GetKeys returns the sorted keys of a session, or nil if the session
+// does not exist.
+func (st *SQLStore) GetKeys(sid string) []string {
+	s := st.load(sid)
+	if s == nil {
+		return nil
+	}
+	return sortedKeys(s.values)
+}
+
+// GetSessionInfos returns map of maps containg all sessions with
+// their key/value pairs. It reads the whole session table, use
+// GetSessionInfoPage for large tables.
+func (st *SQLStore) GetSessionInfos() map[string]map[string]interface{} {
+	infos := make(map[string]map[string]interface{})
+	after := ""
+	for {
+		page, next, err := st.GetSessionInfoPage(after, 100)
+		if err != nil {
+			panic(err)
+		}
+		for _, info := range page {
+			infos[info["_sid"].(string)] = info
+		}
+		if next == "" {
+			return infos
+		}
+		after = next
+	}
+}
+
+// GetSessionInfoPage returns up to limit sessions, ordered by session id,
+// whose ids are greater than after, in the format of GetSessionInfos. It
+// also returns the id to pass as after for the next page, which is empty
+// if there are no more sessions. Start with an empty after. Sessions that
+// cannot be decoded are skipped.
+func (st *SQLStore) GetSessionInfoPage(after string, limit int) ([]map[string]interface{}, string, error) {
+	rows, err := st.db.Query(st.query("SELECT sid, ctime, atime, idle_timeout, max_lifetime, persistent, version, data FROM %s WHERE sid > ? AND expires > ? ORDER BY sid LIMIT ?"),
+		after, time.Now().UnixMilli(), limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("wuppo: cannot list sessions: %w", err)
+	}
+	defer rows.Close()
+	var infos []map[string]interface{}
+	n, last := 0, ""
+	for rows.Next() {
+		s := &sqlSession{}
+		err := st.scan(scanFunc(func(dest ...interface{}) error {
+			return rows.Scan(append([]interface{}{&s.sid}, dest...)...)
+		}), s)
+		if errors.Is(err, errCorruptSession) {
+			// skipped, the next load of the session removes it
+			n, last = n+1, s.sid
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		n, last = n+1, s.sid
+		info := make(map[string]interface{})
+		info["_sid"] = s.sid
+		info["_ctime"] = s.ctime.String()
+		info["_atime"] = s.atime.String()
+		info["_expires"] = st.expiry(s).String()
+		for key := range s.values {
+			info[key] = s.values[key]
+		}
+		infos = append(infos, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("wuppo: cannot list sessions: %w", err)
+	}
+	next := ""
+	if n == limit && limit > 0 {
+		next = last
+	}
+	return infos, next, nil
+}
+
+// scanFunc adapts a function to the Scan method of a row.
+type scanFunc func(dest ...interface{}) error
+
+func (f scanFunc) Scan(dest ...interface{}) error {
+	return f(dest...)
+}
@@ -0,0 +1,285 @@
+package wuppo
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memDriver is a database/sql driver stand-in that understands exactly
+// the statements of SQLStore, on an in-memory session table.
+type memDriver struct {
+	mx      sync.Mutex
+	created bool
+	rows    map[string][]driver.Value // sid -> ctime, atime, idle, max, persistent, expires, version, data
+	queries []string
+}
+
+func (d *memDriver) Open(name string) (driver.Conn, error) {
+	return &memConn{d}, nil
+}
+
+type memConn struct {
+	d *memDriver
+}
+
+func (c *memConn) Prepare(query string) (driver.Stmt, error) {
+	return &memStmt{c.d, query}, nil
+}
+
+func (c *memConn) Close() error {
+	return nil
+}
+
+func (c *memConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions not supported")
+}
+
+type memStmt struct {
+	d     *memDriver
+	query string
+}
+
+func (s *memStmt) Close() error  { return nil }
+func (s *memStmt) NumInput() int { return -1 }
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	d := s.d
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.queries = append(d.queries, s.query)
+	if !d.created && !strings.HasPrefix(s.query, "CREATE") {
+		return nil, fmt.Errorf("no such table")
+	}
+	n := int64(0)
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE"):
+		d.created = true
+	case strings.HasPrefix(s.query, "CREATE INDEX"):
+	case strings.HasPrefix(s.query, "INSERT"):
+		d.rows[args[0].(string)] = []driver.Value{args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8]}
+		n = 1
+	case strings.Contains(s.query, "SET atime = ?, expires = ?"), strings.Contains(s.query, "SET atime = $1, expires = $2"):
+		if row := d.rows[args[2].(string)]; row != nil {
+			row[1], row[5] = args[0], args[1]
+			n = 1
+		}
+	case strings.Contains(s.query, "SET sid"):
+		if row := d.rows[args[1].(string)]; row != nil && row[5].(int64) > args[2].(int64) {
+			d.rows[args[0].(string)] = row
+			delete(d.rows, args[1].(string))
+			n = 1
+		}
+	case strings.HasPrefix(s.query, "UPDATE"):
+		if row := d.rows[args[7].(string)]; row != nil && row[6] == args[8] {
+			copy(row[1:], []driver.Value{args[0], args[1], args[2], args[3], args[4], args[5], args[6]})
+			n = 1
+		}
+	case strings.Contains(s.query, "WHERE sid"):
+		if d.rows[args[0].(string)] != nil {
+			delete(d.rows, args[0].(string))
+			n = 1
+		}
+	case strings.Contains(s.query, "WHERE expires"):
+		for sid, row := range d.rows {
+			if row[5].(int64) <= args[0].(int64) {
+				delete(d.rows, sid)
+				n++
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown statement %q", s.query)
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	d := s.d
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.queries = append(d.queries, s.query)
+	rows := &memRows{}
+	switch {
+	case strings.HasPrefix(s.query, "SELECT ctime"):
+		if row := d.rows[args[0].(string)]; row != nil && row[5].(int64) > args[1].(int64) {
+			rows.values = append(rows.values, []driver.Value{row[0], row[1], row[2], row[3], row[4], row[6], row[7]})
+		}
+	case strings.HasPrefix(s.query, "SELECT sid"):
+		var sids []string
+		for sid, row := range d.rows {
+			if sid > args[0].(string) && row[5].(int64) > args[1].(int64) {
+				sids = append(sids, sid)
+			}
+		}
+		sort.Strings(sids)
+		for i, sid := range sids {
+			if int64(i) < args[2].(int64) {
+				row := d.rows[sid]
+				rows.values = append(rows.values, []driver.Value{sid, row[0], row[1], row[2], row[3], row[4], row[6], row[7]})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown query %q", s.query)
+	}
+	return rows, nil
+}
+
+type memRows struct {
+	values [][]driver.Value
+}
+
+func (r *memRows) Columns() []string {
+	if len(r.values) == 0 {
+		return nil
+	}
+	return make([]string, len(r.values[0]))
+}
+
+func (r *memRows) Close() error {
+	return nil
+}
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var sqlDriverCount int
+
+// openMemDB opens a database with a new memDriver.
+func openMemDB(t *testing.T) (*sql.DB, *memDriver) {
+	d := &memDriver{rows: make(map[string][]driver.Value)}
+	sqlDriverCount++
+	name := fmt.Sprintf("wuppomem%d", sqlDriverCount)
+	sql.Register(name, d)
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, d
+}
+
+func TestSQLStore(t *testing.T) {
+	db, d := openMemDB(t)
+	store := NewSQLStore(db, "", nil)
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	sid := store.PutValue("unknown", "name", "chris")
+	if len(sid) != 32 {
+		t.Fatalf("wanted new session id but was %q", sid)
+	}
+	if store.PutValue(sid, "count", 2) != sid {
+		t.Errorf("wanted same session id")
+	}
+	store.TouchSession(sid)
+	if v := store.GetValue(sid, "name"); v != "chris" {
+		t.Errorf("wanted chris but was %v", v)
+	}
+	if v := store.GetValue(sid, "count"); v != 2 {
+		t.Errorf("wanted 2 but was %v", v)
+	}
+	if version := d.rows[sid][6]; version != int64(1) {
+		t.Errorf("wanted version 1 but was %v", version)
+	}
+	store.SetSessionLifetime(sid, 24*time.Hour, 0)
+	expiry, persistent := store.SessionExpiry(sid)
+	if !persistent || time.Until(expiry) < 23*time.Hour {
+		t.Errorf("wrong expiry %v %v", expiry, persistent)
+	}
+	// expire
+	old := store.PutValue("", "name", "old")
+	d.rows[old][5] = time.Now().Add(-time.Second).UnixMilli()
+	if store.GetValue(old, "name") != nil {
+		t.Errorf("wanted expired session")
+	}
+	store.ExpireSessions()
+	if len(d.rows) != 1 {
+		t.Errorf("wanted 1 session but was %d", len(d.rows))
+	}
+	newSid := store.RenameSession(sid)
+	if store.GetValue(sid, "name") != nil || store.GetValue(newSid, "name") != "chris" {
+		t.Errorf("wanted renamed session")
+	}
+	sid = newSid
+	store.KillSession(sid)
+	if store.GetValue(sid, "name") != nil {
+		t.Errorf("wanted killed session")
+	}
+}
+
+func TestSQLStorePages(t *testing.T) {
+	db, d := openMemDB(t)
+	store := NewSQLStore(db, "sessions", JSONCodec)
+	store.SetNumberedPlaceholders(true)
+	store.Migrate()
+	for i := 0; i < 5; i++ {
+		store.PutValue("", "i", i)
+	}
+	var sids []string
+	after := ""
+	for pages := 1; ; pages++ {
+		page, next, err := store.GetSessionInfoPage(after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range page {
+			sids = append(sids, info["_sid"].(string))
+		}
+		if next == "" {
+			if pages != 3 {
+				t.Errorf("wanted 3 pages but was %d", pages)
+			}
+			break
+		}
+		after = next
+	}
+	if len(sids) != 5 || !sort.StringsAreSorted(sids) {
+		t.Errorf("wrong sids %v", sids)
+	}
+	if len(store.GetSessionInfos()) != 5 {
+		t.Errorf("wanted 5 infos")
+	}
+	for _, q := range d.queries {
+		if strings.Contains(q, "?") || (!strings.HasPrefix(q, "CREATE") && !strings.Contains(q, " sessions ")) {
+			t.Errorf("wrong query %q", q)
+		}
+	}
+}
+
+func TestSQLStoreCorruptRows(t *testing.T) {
+	db, d := openMemDB(t)
+	store := NewSQLStore(db, "", nil)
+	store.Migrate()
+	good := store.PutValue("", "name", "chris")
+	bad := store.PutValue("", "name", "old")
+	d.rows[bad][7] = "not a session"
+	if len(store.GetSessionInfos()) != 1 {
+		t.Errorf("wanted corrupt session to be skipped")
+	}
+	page, next, err := store.GetSessionInfoPage("", 2)
+	if err != nil || len(page) != 1 || next == "" {
+		t.Errorf("wanted one session and a next page but was %v %q %v", page, next, err)
+	}
+	store.TouchSession(bad)
+	if store.GetValue(bad, "name") != nil {
+		t.Errorf("wanted corrupt session to be missing")
+	}
+	if _, ok := d.rows[bad]; ok {
+		t.Errorf("wanted corrupt session to be removed")
+	}
+	if store.GetValue(good, "name") != "chris" {
+		t.Errorf("wanted good session to be kept")
+	}
+}
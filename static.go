@@ -0,0 +1,53 @@
+package wuppo
+
+import (
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+// NewStaticHandler creates a net/http/Handler that serves the static files
+// in directory dir of fsys, for instance an embed.FS that also holds the
+// templates:
+//
+//	//go:embed templates static
+//	var files embed.FS
+//
+//	static, err := wuppo.NewStaticHandler(files, "static")
+//	http.Handle("/static/", http.StripPrefix("/static/", static))
+//
+// Unlike http.FileServer, it does not list directory contents; directories
+// without an index.html file are reported as not found.
+func NewStaticHandler(fsys fs.FS, dir string) (http.Handler, error) {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	return http.FileServer(http.FS(noListFS{sub})), nil
+}
+
+// noListFS is a fs.FS that hides directories without an index.html file.
+type noListFS struct {
+	fsys fs.FS
+}
+
+func (nl noListFS) Open(name string) (fs.File, error) {
+	f, err := nl.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := nl.fsys.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		index.Close()
+	}
+	return f, nil
+}
@@ -0,0 +1,248 @@
+package wuppo
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// templateCache parses the templates of a Handler once and caches them.
+// In development mode, it checks the template files on every access and
+// re-parses them if a file was added, removed or modified.
+type templateCache struct {
+	fsys     fs.FS
+	patterns []string
+	funcmap  template.FuncMap
+	mx       sync.RWMutex
+	dev      bool
+	set      *templateSet
+	stamp    string
+}
+
+// newTemplateCache creates a templateCache and parses the templates in
+// fsys that match one of the patterns. It returns an error if parsing
+// fails. See fs.Glob for the pattern syntax.
+func newTemplateCache(fsys fs.FS, patterns []string, funcmap template.FuncMap) (*templateCache, error) {
+	tc := &templateCache{
+		fsys:     fsys,
+		patterns: patterns,
+		funcmap:  funcmap,
+	}
+	stamp, err := tc.check()
+	if err != nil {
+		return nil, err
+	}
+	if err := tc.parse(stamp); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// splitGlob splits a file system glob pattern into a directory that
+// contains no glob characters and a fs.Glob pattern relative to that
+// directory. For instance "templates/*.html" is split into "templates" and
+// "*.html".
+func splitGlob(pattern string) (string, string) {
+	dir := filepath.Dir(pattern)
+	rest := filepath.Base(pattern)
+	for strings.ContainsAny(dir, "*?[") && dir != filepath.Dir(dir) {
+		rest = filepath.Base(dir) + "/" + rest
+		dir = filepath.Dir(dir)
+	}
+	return dir, rest
+}
+
+// setDev turns development mode on or off.
+func (tc *templateCache) setDev(dev bool) {
+	tc.mx.Lock()
+	defer tc.mx.Unlock()
+	tc.dev = dev
+}
+
+// get returns the cached templates. In development mode, it re-parses
+// the templates first if they have changed.
+func (tc *templateCache) get() (*templateSet, error) {
+	tc.mx.RLock()
+	dev, set, stamp := tc.dev, tc.set, tc.stamp
+	tc.mx.RUnlock()
+	if !dev {
+		return set, nil
+	}
+	newStamp, err := tc.check()
+	if err != nil {
+		return nil, err
+	}
+	if newStamp != stamp {
+		if err := tc.parse(newStamp); err != nil {
+			return nil, err
+		}
+	}
+	tc.mx.RLock()
+	defer tc.mx.RUnlock()
+	return tc.set, nil
+}
+
+// files returns the sorted names of all files that match one of the
+// patterns.
+func (tc *templateCache) files() ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range tc.patterns {
+		matches, err := fs.Glob(tc.fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range matches {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// check returns a stamp made of the names, sizes and modification times of
+// all template files. The stamp changes whenever a template file changes.
+func (tc *templateCache) check() (string, error) {
+	files, err := tc.files()
+	if err != nil {
+		return "", err
+	}
+	stamp := ""
+	for _, file := range files {
+		info, err := fs.Stat(tc.fsys, file)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%s_%d_%d_", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+// parse parses all template files and stores them in the cache. Templates
+// are named after the base names of their files, so two files with the
+// same base name are an error. It is not an error if no file matches the
+// patterns.
+func (tc *templateCache) parse(stamp string) error {
+	files, err := tc.files()
+	if err != nil {
+		return err
+	}
+	set := &templateSet{
+		base:    template.New("").Funcs(tc.funcmap),
+		funcmap: tc.funcmap,
+		sources: make(map[string]string),
+		extends: make(map[string]string),
+		layouts: make(map[string]*template.Template),
+	}
+	seen := make(map[string]string)
+	for _, file := range files {
+		name := path.Base(file)
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("wuppo: templates %q and %q have the same name %q", other, file, name)
+		}
+		seen[name] = file
+		data, err := fs.ReadFile(tc.fsys, file)
+		if err != nil {
+			return err
+		}
+		if err := set.add(name, string(data)); err != nil {
+			return err
+		}
+	}
+	tc.mx.Lock()
+	defer tc.mx.Unlock()
+	tc.set = set
+	tc.stamp = stamp
+	return nil
+}
+
+// extendsRegexp matches the comment a page template uses to declare its
+// layout, for instance {{/* extends "layout.html" */}}.
+var extendsRegexp = regexp.MustCompile(`\{\{-?\s*/\*\s*extends\s+"([^"]+)"\s*\*/\s*-?\}\}`)
+
+// A templateSet holds the parsed templates, and the page/layout
+// combinations that were built from them.
+//
+// Templates are named after their file names. A page is rendered in a
+// layout by parsing the layout, all partials (templates whose names start
+// with an underscore) and the page into a new template. The page becomes
+// the "content" template, so the layout includes it with
+// {{block "content" .}}{{end}}. Templates defined by the page replace the
+// blocks of the layout with the same name.
+type templateSet struct {
+	base    *template.Template
+	funcmap template.FuncMap
+	sources map[string]string
+	extends map[string]string
+	mx      sync.Mutex
+	layouts map[string]*template.Template
+}
+
+// add parses a template source.
+func (set *templateSet) add(name string, source string) error {
+	if _, err := set.base.New(name).Parse(source); err != nil {
+		return err
+	}
+	set.sources[name] = source
+	if m := extendsRegexp.FindStringSubmatch(source); m != nil {
+		set.extends[name] = m[1]
+	}
+	return nil
+}
+
+// layoutOf returns the layout that a page declares, or "".
+func (set *templateSet) layoutOf(page string) string {
+	return set.extends[page]
+}
+
+// isPartial returns true if name is a partial template.
+func isPartial(name string) bool {
+	return strings.HasPrefix(name, "_")
+}
+
+// lookup returns the template to execute for a page and a layout, and the
+// name to execute. If layout is "", the page is rendered without layout.
+func (set *templateSet) lookup(page string, layout string) (*template.Template, string, error) {
+	if layout == "" || layout == page {
+		return set.base, page, nil
+	}
+	key := page + "|" + layout
+	set.mx.Lock()
+	defer set.mx.Unlock()
+	if t := set.layouts[key]; t != nil {
+		return t, layout, nil
+	}
+	pageSource, ok := set.sources[page]
+	if !ok {
+		return nil, "", fmt.Errorf("wuppo: template %q not found", page)
+	}
+	layoutSource, ok := set.sources[layout]
+	if !ok {
+		return nil, "", fmt.Errorf("wuppo: layout %q not found", layout)
+	}
+	t := template.New(layout).Funcs(set.funcmap)
+	for name, source := range set.sources {
+		if isPartial(name) && name != page && name != layout {
+			if _, err := t.New(name).Parse(source); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	if _, err := t.Parse(layoutSource); err != nil {
+		return nil, "", err
+	}
+	if _, err := t.New("content").Parse(pageSource); err != nil {
+		return nil, "", err
+	}
+	set.layouts[key] = t
+	return t, layout, nil
+}
@@ -0,0 +1,38 @@
+package wuppo
+
+// SessionGet returns the named session value as a T. It returns false if
+// the value does not exist or is not a T, so it never panics:
+//
+//	name, ok := wuppo.SessionGet[string](req, "name")
+//
+// Note that stores which encode values with JSONCodec return numbers as
+// float64, objects as map[string]interface{} and arrays as []interface{}.
+func SessionGet[T any](req Req, name string) (T, bool) {
+	value, ok := req.SessionValue(name).(T)
+	return value, ok
+}
+
+// SessionDelete removes the named value from the session.
+// See Req.DeleteSessionValue.
+func SessionDelete(req Req, name string) {
+	req.DeleteSessionValue(name)
+}
+
+// SessionKeys returns the sorted names of the session values.
+// See Req.SessionKeys.
+func SessionKeys(req Req) []string {
+	return req.SessionKeys()
+}
+
+// SessionClear removes all values from the session, but keeps the session
+// and its id. See Req.ClearSession.
+func SessionClear(req Req) {
+	req.ClearSession()
+}
+
+// ModelGet returns the named model value as a T. It returns false if the
+// value does not exist or is not a T, so it never panics.
+func ModelGet[T any](req Req, name string) (T, bool) {
+	value, ok := req.ModelValue(name).(T)
+	return value, ok
+}
@@ -2,11 +2,16 @@
 package wuppo
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
-	"time"
+	"net/netip"
+	"runtime/debug"
 )
 
 // Handler is a net/http/Handler implementation that serves as entry
@@ -14,8 +19,20 @@ import (
 type Handler struct {
 	serve           ServeFunc
 	store           SessionStore
-	templatePattern string
-	funcmap         template.FuncMap
+	templates       *templateCache
+	logger          *slog.Logger
+	cookie          CookieConfig
+	rotateKeys      map[string]bool
+	csrf            *csrf
+	trustedProxies  []netip.Prefix
+	forwardedHeader string
+	httpMiddlewares []HTTPMiddleware
+	middlewares     []Middleware
+	jsonOptions     JSONOptions
+	errorPages      map[int]errorPage
+	defaultLayout   string
+	dev             bool
+	janitor         *janitor
 }
 
 // ServeFunc is a callback method that responds to an incoming request.
@@ -24,57 +41,255 @@ type ServeFunc func(req Req)
 // NewHandler creates a new Handler with a ServerFunc and a SessionStore.
 // See https://golang.org/pkg/html/template/#ParseGlob for a description of the templatePattern.
 // See https://golang.org/pkg/html/template/#FuncMap for a description of the funcmap.
-func NewHandler(serve ServeFunc, sessionStore SessionStore, templatePattern string, funcmap template.FuncMap) Handler {
-	h := Handler{
-		serve:           serve,
-		store:           sessionStore,
-		templatePattern: templatePattern,
-		funcmap:         funcmap,
-	}
-	return h
+// The templates are parsed once and cached, NewHandler returns an error if
+// they cannot be parsed. It is not an error if no file matches the pattern.
+// An empty templatePattern loads no templates; use SetTemplateFS to load
+// them from a fs.FS instead.
+// The Handler has the default middleware AccessLog installed, use
+// ClearMiddleware to remove it. Old sessions are expired by a background
+// janitor, use Close to stop it. Stores that expire sessions themselves,
+// like CookieStore and RedisStore, get no janitor.
+func NewHandler(serve ServeFunc, sessionStore SessionStore, templatePattern string, funcmap template.FuncMap) (*Handler, error) {
+	return New(serve,
+		WithSessionStore(sessionStore),
+		WithTemplatePattern(templatePattern),
+		WithFuncMap(funcmap),
+	)
 }
 
 // NewDefaultHandler creates a new handler with a ServerFunc function and a
 // in-memory session store. Templates are loaded from "*.html". Funcmap is nil.
-func NewDefaultHandler(serve ServeFunc) Handler {
-	memstore := NewMemStore()
-	h := Handler{
-		serve,
-		memstore,
-		"*.html",
-		nil,
-	}
-	return h
+func NewDefaultHandler(serve ServeFunc) (*Handler, error) {
+	return New(serve)
+}
+
+// SetDevMode turns development mode on or off. In development mode, the
+// Handler re-parses the templates whenever a template file changes, and
+// shows panics and rendering errors on a detailed developer error page,
+// with stack trace, request dump and model. Development mode is off by default.
+func (handler *Handler) SetDevMode(dev bool) {
+	handler.dev = dev
+	handler.templates.setDev(dev)
+}
+
+// SetTemplateFS replaces the templates of the Handler with the templates in
+// fsys that match one of the patterns, for instance an embed.FS:
+//
+//	//go:embed templates
+//	var templates embed.FS
+//
+//	err := handler.SetTemplateFS(templates, "templates/*.html", "templates/layouts/*.html")
+//
+// Templates are named after the base names of their files, which must be
+// unique across all patterns. The funcmap and development mode of the
+// Handler are kept. SetTemplateFS returns an error if the templates cannot
+// be parsed. See fs.Glob for the pattern syntax.
+func (handler *Handler) SetTemplateFS(fsys fs.FS, patterns ...string) error {
+	templates, err := newTemplateCache(fsys, patterns, handler.templates.funcmap)
+	if err != nil {
+		return err
+	}
+	templates.setDev(handler.dev)
+	handler.templates = templates
+	return nil
+}
+
+// SetDefaultLayout sets the layout that page templates are rendered in if
+// neither the page nor the Req set a layout. A page declares its layout with
+// a comment at its beginning:
+//
+//	{{/* extends "layout.html" */}}
+//
+// The page becomes the "content" template of the layout, and templates
+// defined by the page replace the blocks of the layout with the same name:
+//
+//	<title>{{block "title" .}}Default Title{{end}}</title>
+//	<body>{{block "content" .}}{{end}}</body>
+//
+// Templates whose file names start with an underscore are partials. They
+// are available in all layouts and are rendered without layout when used as
+// a page. The default is no layout.
+func (handler *Handler) SetDefaultLayout(layout string) {
+	handler.defaultLayout = layout
+}
+
+// Use appends middlewares that wrap the ServeFunc. Middlewares run in the
+// order they were added, after all HTTPMiddlewares. Use must not be called
+// while the Handler is serving requests.
+func (handler *Handler) Use(middlewares ...Middleware) {
+	handler.middlewares = append(handler.middlewares, middlewares...)
+}
+
+// UseHTTP appends middlewares that wrap the whole request processing,
+// including the creation of the Req and the rendering of the response.
+// HTTPMiddlewares run in the order they were added. UseHTTP must not be
+// called while the Handler is serving requests.
+func (handler *Handler) UseHTTP(middlewares ...HTTPMiddleware) {
+	handler.httpMiddlewares = append(handler.httpMiddlewares, middlewares...)
+}
+
+// ClearMiddleware removes all middlewares, including the default ones.
+func (handler *Handler) ClearMiddleware() {
+	handler.httpMiddlewares = nil
+	handler.middlewares = nil
+}
+
+// SetJSONOptions sets the options for Req.BindJSON. The default is
+// DefaultJSONOptions.
+func (handler *Handler) SetJSONOptions(opts JSONOptions) {
+	handler.jsonOptions = opts
 }
 
 // ServeHTTP implements the net/http/Handler interface.
-// It creates a new Req and sends it to the user-defnied ServeFunc.
-func (handler Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL.Path)
-	t1 := time.Now()
-	handler.store.ExpireSessions()
-	req := newReqImpl(w, r, handler.store)
-	handler.serve(req)
+// It runs the HTTPMiddlewares, creates a new Req and sends it through the
+// Middlewares to the user-defined ServeFunc. If the ServeFunc sets more
+// than one response, the first of HTML, template, JSON, bytes, file,
+// reader, stream and redirect wins and a warning is logged; in
+// development mode, the Handler responds with an error instead.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := ChainHTTP(http.HandlerFunc(handler.serveHTTP), handler.httpMiddlewares...)
+	h.ServeHTTP(w, r)
+}
+
+// serveHTTP creates a new Req, calls the ServeFunc and renders the response.
+// It recovers from panics and responds with the error page for status 500.
+func (handler *Handler) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	req := newReqImpl(w, r, handler)
+	defer func() {
+		if c, ok := req.reader.(io.Closer); ok {
+			c.Close()
+		}
+	}()
+	if rec := accessRecordOf(r); rec != nil {
+		defer func() {
+			rec.sid = req.sid
+		}()
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			stack := debug.Stack()
+			handler.logger.Error("wuppo: panic", "method", r.Method, "path", r.URL.Path, "panic", v, "stack", string(stack))
+			handler.serveError(w, r, req, http.StatusInternalServerError, fmt.Errorf("panic: %v", v), stack)
+		}
+	}()
+	req.loadSession()
+	if handler.csrf != nil && !handler.csrf.check(req) {
+		handler.logger.Warn("wuppo: invalid CSRF token", "method", r.Method, "path", r.URL.Path)
+		handler.serveError(w, r, req, http.StatusForbidden, nil, nil)
+		return
+	}
+	Chain(handler.serve, handler.middlewares...)(req)
+	if err := req.checkResponse(); err != nil {
+		if handler.dev {
+			handler.serveError(w, r, req, http.StatusInternalServerError, err, nil)
+			return
+		}
+		handler.logger.Warn("wuppo: invalid response", "method", r.Method, "path", r.URL.Path, "err", err)
+	}
+	var page []byte
+	if req.html == "" && req.template != "" {
+		// the page is executed before the session cookie is written,
+		// because it can add values to the session, like a CSRF token
+		req.exposeFlashes()
+		var err error
+		if page, err = handler.execute(req, req.template); err != nil {
+			handler.logger.Error("wuppo: cannot render response", "method", r.Method, "path", r.URL.Path, "err", err)
+			handler.serveError(w, r, req, http.StatusInternalServerError, err, nil)
+			return
+		}
+	}
+	if err := req.commitSession(); err != nil {
+		handler.logger.Error("wuppo: cannot write session cookie", "method", r.Method, "path", r.URL.Path, "err", err)
+		handler.serveError(w, r, req, http.StatusInternalServerError, err, nil)
+		return
+	}
+	req.writeHeaders()
+	if err := handler.render(w, r, req, page); err != nil {
+		handler.logger.Error("wuppo: cannot render response", "method", r.Method, "path", r.URL.Path, "err", err)
+		handler.serveError(w, r, req, http.StatusInternalServerError, err, nil)
+	}
+}
+
+// render writes the response that was set on req. The page is the
+// executed template of a template response. It returns an error, and
+// writes nothing, if the response cannot be rendered.
+func (handler *Handler) render(w http.ResponseWriter, r *http.Request, req *reqImpl, page []byte) error {
 	if req.html != "" {
-		io.WriteString(w, req.html)
+		writeBody(w, req.status, "text/html; charset=utf-8", []byte(req.html))
 	} else if req.template != "" {
-		t := template.New("").Funcs(handler.funcmap)
-		t, err := t.ParseGlob(handler.templatePattern)
-		if err != nil {
-			panic(err)
-		}
-		err = t.ExecuteTemplate(w, req.template, req.model)
+		writeBody(w, req.status, "text/html; charset=utf-8", page)
+	} else if req.hasJSON {
+		data, err := json.Marshal(req.json)
 		if err != nil {
-			panic(err)
+			return err
 		}
+		writeBody(w, req.status, "application/json; charset=utf-8", data)
+	} else if req.hasBytes {
+		writeBody(w, req.status, req.bytesType, req.bytes)
+	} else if req.file != "" {
+		return handler.serveFile(w, r, req)
+	} else if req.reader != nil {
+		http.ServeContent(w, r, req.name, req.modtime, req.reader)
+	} else if req.stream != nil {
+		return handler.serveStream(w, r, req)
 	} else if req.redirect != "" {
-		http.Redirect(w, r, req.redirect, http.StatusFound)
+		http.Redirect(w, r, req.redirect, req.redirectStatus())
+	} else if req.status >= 400 {
+		handler.serveError(w, r, req, req.status, nil, nil)
 	} else if req.status != 0 {
 		msg := http.StatusText(req.status)
 		http.Error(w, msg, req.status)
 	} else {
 		io.WriteString(w, "no result")
 	}
-	d := time.Since(t1)
-	fmt.Printf("%s %s %s - %f s\n", r.RemoteAddr, r.Method, r.URL.Path, float64(d)/1e9)
+	return nil
+}
+
+// writeBody writes a response body with a status code, which defaults to
+// 200. The contentType applies unless it is empty or the ServeFunc has
+// set one with Req.SetHeader.
+func writeBody(w http.ResponseWriter, code int, contentType string, body []byte) {
+	if contentType != "" && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if code != 0 {
+		w.WriteHeader(code)
+	}
+	w.Write(body)
+}
+
+// execute executes a page template with the model of req into a byte
+// slice. The page is rendered in the layout set by req.SetLayout, or else in
+// the layout the page declares, or else in the default layout. Partials are
+// rendered without layout, unless req.SetLayout was called.
+func (handler *Handler) execute(req *reqImpl, page string) ([]byte, error) {
+	set, err := handler.templates.get()
+	if err != nil {
+		return nil, err
+	}
+	layout := handler.defaultLayout
+	if l := set.layoutOf(page); l != "" {
+		layout = l
+	}
+	if isPartial(page) {
+		layout = ""
+	}
+	if req.hasLayout {
+		layout = req.layout
+	}
+	t, name, err := set.lookup(page, layout)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, req.model); err != nil {
+		return nil, err
+	}
+	if handler.csrf != nil {
+		return handler.csrf.insertToken(buf.Bytes(), req), nil
+	}
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,1015 @@
+package wuppo
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestServeJSON(t *testing.T) {
+	h, err := NewHandler(func(req Req) {
+		var in struct{ Name string }
+		if err := req.BindJSON(&in); err != nil {
+			req.SetJSONStatus(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.SetJSON(map[string]string{"hello": in.Name})
+	}, NewMemStore(), "*.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	h.ClearMiddleware()
+	h.SetJSONOptions(JSONOptions{MaxBytes: 32, DisallowUnknownFields: true})
+	tests := []struct {
+		body   string
+		status int
+		resp   string
+	}{
+		{`{"name":"chris"}`, 200, `{"hello":"chris"}`},
+		{`{"name":"chris","age":3}`, 400, `unknown field`},
+		{`{"name":"chris"} {}`, 400, `single value`},
+		{`{"name":"` + strings.Repeat("x", 40) + `"}`, 400, `too large`},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: wanted status %d but was %d", test.body, test.status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("%s: wrong Content-Type %q", test.body, ct)
+		}
+		if !strings.Contains(w.Body.String(), test.resp) {
+			t.Errorf("%s: wanted %q in %q", test.body, test.resp, w.Body.String())
+		}
+	}
+}
+
+func TestReqStubBindJSON(t *testing.T) {
+	req := NewReqStub("POST", "/")
+	req.Body = []byte(`{"name":"chris"}`)
+	var in struct{ Name string }
+	if err := req.BindJSON(&in); err != nil {
+		t.Fatal(err)
+	}
+	if in.Name != "chris" {
+		t.Errorf("wanted chris but was %q", in.Name)
+	}
+	req.SetJSONStatus(201, in)
+	if !req.HasJSON || req.Status != 201 {
+		t.Errorf("wanted JSON response with status 201")
+	}
+}
+
+func TestTemplateCache(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index.html")
+	os.WriteFile(file, []byte("hello {{.name}}"), 0644)
+	h, err := NewHandler(func(req Req) {
+		req.SetModelValue("name", "chris")
+		req.SetTemplate("index.html")
+	}, NewMemStore(), filepath.Join(dir, "*.html"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	h.ClearMiddleware()
+	get := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Body.String()
+	}
+	if got := get(); got != "hello chris" {
+		t.Errorf("wanted 'hello chris' but was %q", got)
+	}
+	// without dev mode, changes are not seen
+	os.WriteFile(file, []byte("bye {{.name}}"), 0644)
+	if got := get(); got != "hello chris" {
+		t.Errorf("wanted 'hello chris' but was %q", got)
+	}
+	h.SetDevMode(true)
+	if got := get(); got != "bye chris" {
+		t.Errorf("wanted 'bye chris' but was %q", got)
+	}
+	// parse errors are returned from the constructor
+	os.WriteFile(file, []byte("{{.name"), 0644)
+	if _, err := NewHandler(nil, NewMemStore(), filepath.Join(dir, "*.html"), nil); err == nil {
+		t.Errorf("wanted parse error")
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "error.html"), []byte("oops {{.status}}"), 0644)
+	h, err := NewHandler(func(req Req) {
+		switch req.Path() {
+		case "/panic":
+			var m map[string]string
+			m["x"] = "boom"
+		case "/missing":
+			req.SetStatus(http.StatusNotFound)
+		case "/teapot":
+			req.SetStatus(http.StatusTeapot)
+		}
+	}, NewMemStore(), filepath.Join(dir, "*.html"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	h.ClearMiddleware()
+	h.SetErrorTemplate(0, "error.html")
+	h.SetErrorServe(http.StatusTeapot, func(req Req) {
+		req.SetHTML("short and stout")
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/panic", 500, "oops 500"},
+		{"/missing", 404, "oops 404"},
+		{"/teapot", 418, "short and stout"},
+	}
+	for _, test := range tests {
+		w := get(test.path)
+		if w.Code != test.status || w.Body.String() != test.body {
+			t.Errorf("%s: wanted %d %q but was %d %q", test.path, test.status, test.body, w.Code, w.Body.String())
+		}
+	}
+	h.SetDevMode(true)
+	w := get("/panic")
+	if w.Code != 500 || !strings.Contains(w.Body.String(), "assignment to entry in nil map") {
+		t.Errorf("wanted developer error page but was %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"layout.html": `<title>{{block "title" .}}default{{end}}</title>{{block "content" .}}{{end}}{{template "_foot.html"}}`,
+		"other.html":  `other[{{block "content" .}}{{end}}]`,
+		"_foot.html":  `<footer>`,
+		"page.html":   `{{define "title"}}page{{end}}hello {{.name}}`,
+		"plain.html":  `{{/* extends "other.html" */}}plain`,
+	}
+	for name, text := range files {
+		os.WriteFile(filepath.Join(dir, name), []byte(text), 0644)
+	}
+	var page, layout string
+	var setLayout bool
+	h, err := NewHandler(func(req Req) {
+		req.SetModelValue("name", "chris")
+		req.SetTemplate(page)
+		if setLayout {
+			req.SetLayout(layout)
+		}
+	}, NewMemStore(), filepath.Join(dir, "*.html"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	h.ClearMiddleware()
+	h.SetDefaultLayout("layout.html")
+	tests := []struct {
+		page      string
+		layout    string
+		setLayout bool
+		want      string
+	}{
+		{"page.html", "", false, "<title>page</title>hello chris<footer>"},
+		{"plain.html", "", false, "other[plain]"},
+		{"page.html", "other.html", true, "other[hello chris]"},
+		{"page.html", "", true, "hello chris"},
+		{"_foot.html", "", false, "<footer>"},
+	}
+	for _, test := range tests {
+		page, layout, setLayout = test.page, test.layout, test.setLayout
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("%s in %q: wanted %q but was %q", test.page, test.layout, test.want, got)
+		}
+	}
+}
+
+func TestTemplateFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"web/pages/index.html":     {Data: []byte(`{{/* extends "base.html" */}}index`)},
+		"web/layouts/base.html":    {Data: []byte(`<b>{{block "content" .}}{{end}}</b>`)},
+		"web/static/app.css":       {Data: []byte(`body {}`)},
+		"web/static/sub/other.css": {Data: []byte(`p {}`)},
+	}
+	h, err := NewHandler(func(req Req) {
+		req.SetTemplate("index.html")
+	}, NewMemStore(), "does-not-exist/*.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	h.ClearMiddleware()
+	if err := h.SetTemplateFS(fsys, "web/pages/*.html", "web/layouts/*.html"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Body.String(); got != "<b>index</b>" {
+		t.Errorf("wanted <b>index</b> but was %q", got)
+	}
+	fsys["web/layouts/index.html"] = &fstest.MapFile{Data: []byte(`other`)}
+	if err := h.SetTemplateFS(fsys, "web/pages/*.html", "web/layouts/*.html"); err == nil || !strings.Contains(err.Error(), "same name") {
+		t.Errorf("wanted error for duplicate template name but was %v", err)
+	}
+	static, err := NewStaticHandler(fsys, "web/static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]int{
+		"/app.css":       200,
+		"/sub/other.css": 200,
+		"/sub/":          404,
+		"/missing.css":   404,
+	}
+	for path, status := range tests {
+		w := httptest.NewRecorder()
+		static.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: wanted %d but was %d", path, status, w.Code)
+		}
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html": {Data: []byte(`{{shout .name}}`)},
+	}
+	store := NewMemStore()
+	var trace []string
+	h, err := New(func(req Req) {
+		trace = append(trace, "serve")
+		req.SetSessionValue("name", "chris")
+		req.SetModelValue("name", "chris")
+		req.SetTemplate("index.html")
+	},
+		WithSessionStore(store),
+		WithTemplates(fsys, "*.html"),
+		WithFuncMap(template.FuncMap{"shout": strings.ToUpper}),
+		WithCookieName("SID"),
+		WithSessionTTL(time.Hour),
+		WithoutDefaultMiddleware(),
+		WithMiddleware(func(next ServeFunc) ServeFunc {
+			return func(req Req) {
+				trace = append(trace, "mw")
+				next(req)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	if len(h.httpMiddlewares) != 0 {
+		t.Errorf("wanted no default middlewares")
+	}
+	if store.idleTimeout != time.Hour {
+		t.Errorf("wanted idle timeout 1h but was %s", store.idleTimeout)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Body.String(); got != "CHRIS" {
+		t.Errorf("wanted CHRIS but was %q", got)
+	}
+	if got := strings.Join(trace, ","); got != "mw,serve" {
+		t.Errorf("wanted mw,serve but was %s", got)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].Name != "SID" {
+		t.Errorf("wanted cookie SID but was %v", c)
+	}
+	if _, err := New(nil, WithSessionStore(sessionStoreWithoutTTL{store}), WithSessionTTL(time.Hour)); err == nil {
+		t.Errorf("wanted error for store without TTL")
+	}
+}
+
+type sessionStoreWithoutTTL struct {
+	SessionStore
+}
+
+// panicStore is a session store that fails on every access, like a
+// store whose database is down.
+type panicStore struct {
+	SessionStore
+}
+
+func (panicStore) TouchSession(sid string) {
+	panic("database is down")
+}
+
+func TestStorePanic(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := New(func(req Req) {
+		req.SetHTML("ok")
+	}, WithSessionStore(panicStore{NewMemStore()}), WithTemplatePattern(""), WithoutDefaultMiddleware(),
+		WithHTTPMiddleware(AccessLogFormat(&buf, LogFormatCommon)), WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "abc"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wanted 500 but was %d", w.Code)
+	}
+	if !strings.Contains(buf.String(), `"GET / HTTP/1.1" 500`) {
+		t.Errorf("wanted access log entry but was %q", buf.String())
+	}
+}
+
+func TestSessionCookieMaxAge(t *testing.T) {
+	h, err := New(func(req Req) {
+		req.SetSessionValue("name", "chris")
+		if req.FormValue("remember") != "" {
+			req.SetSessionLifetime(30*24*time.Hour, 0)
+		}
+	}, WithTemplatePattern(""), WithoutDefaultMiddleware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	cookie := func(path string) *http.Cookie {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		cookies := w.Result().Cookies()
+		if len(cookies) == 0 {
+			t.Fatalf("%s: no cookie", path)
+		}
+		return cookies[len(cookies)-1]
+	}
+	if c := cookie("/"); c.MaxAge != 0 {
+		t.Errorf("wanted session cookie but MaxAge was %d", c.MaxAge)
+	}
+	if c := cookie("/?remember=1"); c.MaxAge < 30*24*3600-5 {
+		t.Errorf("wanted 30 days but MaxAge was %d", c.MaxAge)
+	}
+}
+
+func TestCookieConfig(t *testing.T) {
+	serve := func(cfg CookieConfig, path string, header string, opts ...Option) *http.Cookie {
+		h, err := New(func(req Req) {
+			if req.Path() == "/logout" {
+				req.KillSession()
+			} else {
+				req.SetSessionValue("name", "chris")
+			}
+			req.SetHTML("ok")
+		}, append([]Option{WithTemplatePattern(""), WithoutDefaultMiddleware(), WithCookieConfig(cfg)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "10.0.0.1:4711"
+		if name, value, ok := strings.Cut(header, ": "); ok {
+			r.Header.Set(name, value)
+		}
+		if path == "/logout" {
+			r.AddCookie(&http.Cookie{Name: "sid", Value: "abc"})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("wanted one cookie but was %v", cookies)
+		}
+		return cookies[0]
+	}
+	c := serve(CookieConfig{}, "/", "")
+	if c.Name != DefaultCookieName || c.Path != "/" || c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode || c.MaxAge != 0 {
+		t.Errorf("wrong default cookie %v", c)
+	}
+	trust := WithTrustedProxies("10.0.0.1")
+	if c := serve(CookieConfig{}, "/", "X-Forwarded-Proto: https", trust); !c.Secure {
+		t.Errorf("wanted secure cookie behind TLS proxy")
+	}
+	if c := serve(CookieConfig{}, "/", "X-Forwarded-Proto: https"); c.Secure {
+		t.Errorf("wanted insecure cookie behind untrusted proxy")
+	}
+	if c := serve(CookieConfig{}, "/", "Forwarded: proto=https", trust); c.Secure {
+		t.Errorf("wanted insecure cookie with Forwarded not set by the proxy")
+	}
+	if c := serve(CookieConfig{}, "/", "Forwarded: proto=http, for=10.0.0.2;proto=https", trust, WithForwardedHeader("Forwarded")); !c.Secure {
+		t.Errorf("wanted secure cookie behind TLS proxy with Forwarded")
+	}
+	if c := serve(CookieConfig{Secure: CookieSecureNever}, "/", "X-Forwarded-Proto: https", trust); c.Secure {
+		t.Errorf("wanted insecure cookie")
+	}
+	cfg := CookieConfig{Name: "sid", Domain: "example.com", Path: "/app", Secure: CookieSecureAlways, SameSite: http.SameSiteStrictMode, Persistent: true}
+	c = serve(cfg, "/", "")
+	if c.Name != "sid" || c.Domain != "example.com" || c.Path != "/app" || !c.Secure || c.SameSite != http.SameSiteStrictMode {
+		t.Errorf("wrong cookie %v", c)
+	}
+	if c.MaxAge < 29*60 || c.MaxAge > 30*60 {
+		t.Errorf("wanted persistent cookie but MaxAge was %d", c.MaxAge)
+	}
+	if c := serve(cfg, "/logout", ""); c.Name != "sid" || c.MaxAge != -1 {
+		t.Errorf("wanted expiring cookie but was %v", c)
+	}
+}
+
+func TestRegenerateSession(t *testing.T) {
+	h, err := New(func(req Req) {
+		switch req.Path() {
+		case "/visit":
+			req.SetSessionValue("visited", true)
+		case "/login":
+			req.SetSessionValue("user", "chris")
+		}
+		user, _ := req.SessionValue("user").(string)
+		req.SetHTML("hello " + user)
+	}, WithTemplatePattern(""), WithoutDefaultMiddleware(), WithSessionRotation("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	serve := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	planted := serve("/visit", nil).Result().Cookies()[0]
+	w := serve("/login", planted)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value == planted.Value {
+		t.Fatalf("wanted new session cookie but was %v", cookies)
+	}
+	if w := serve("/", planted); w.Body.String() != "hello " {
+		t.Errorf("planted session id must not be logged in but was %q", w.Body.String())
+	}
+	if w := serve("/", cookies[0]); w.Body.String() != "hello chris" {
+		t.Errorf("wanted logged in session but was %q", w.Body.String())
+	}
+	req := NewReqStub("GET", "/")
+	req.RegenerateSession()
+	if !req.Regenerated {
+		t.Errorf("wanted ReqStub to record regeneration")
+	}
+}
+
+func TestFlashes(t *testing.T) {
+	cookieStore, _ := NewCookieStore(JSONCodec, bytes.Repeat([]byte("s"), 32))
+	for _, store := range []SessionStore{NewMemStore(), cookieStore} {
+		h, err := New(func(req Req) {
+			if req.Path() == "/save" {
+				req.AddFlash("info", "saved")
+				req.AddFlash("error", "almost")
+				req.SetRedirect("/")
+				return
+			}
+			req.SetTemplate("page.html")
+		}, WithSessionStore(store), WithTemplates(fstest.MapFS{
+			"page.html": {Data: []byte(`{{range .flashes}}[{{.Kind}}:{{.Message}}]{{end}}`)},
+		}, "*.html"), WithoutDefaultMiddleware())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		serve := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", path, nil)
+			if cookie != nil {
+				r.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w
+		}
+		w := serve("/save", nil)
+		cookie := w.Result().Cookies()[0]
+		w = serve("/", cookie)
+		if w.Body.String() != "[info:saved][error:almost]" {
+			t.Errorf("%T: wrong flashes %q", store, w.Body.String())
+		}
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			cookie = cookies[0]
+		}
+		if w := serve("/", cookie); w.Body.String() != "" {
+			t.Errorf("%T: wanted flashes to be consumed but was %q", store, w.Body.String())
+		}
+	}
+	req := NewReqStub("GET", "/")
+	req.AddFlash("info", "saved")
+	if len(req.FlashList) != 1 || len(req.Flashes()) != 1 || len(req.FlashList) != 0 {
+		t.Errorf("wrong ReqStub flashes")
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	cookieStore, _ := NewCookieStore(nil, bytes.Repeat([]byte("s"), 32))
+	for _, store := range []SessionStore{NewMemStore(), cookieStore} {
+		h, err := New(func(req Req) {
+			if req.IsGet() {
+				req.SetTemplate("form.html")
+				return
+			}
+			req.SetHTML("ok")
+		}, WithSessionStore(store), WithCSRF(CSRFConfig{Exempt: []string{"/api/", "/hook"}}), WithTemplates(fstest.MapFS{
+			"form.html":    {Data: []byte(`<form>{{csrfField}}</form><meta content="{{csrfToken}}">`)},
+			"_denied.html": {Data: []byte(`denied {{.status}}`)},
+		}, "*.html"), WithErrorTemplate(http.StatusForbidden, "_denied.html"), WithoutDefaultMiddleware())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		cookie := w.Result().Cookies()[0]
+		body := w.Body.String()
+		i := strings.Index(body, `value="`)
+		if i < 0 || strings.Contains(body, "wuppocsrf") {
+			t.Fatalf("%T: wrong form %q", store, body)
+		}
+		token := body[i+7 : i+7+32]
+		if !strings.Contains(body, `name="csrf_token"`) || !strings.Contains(body, `content="`+token+`"`) {
+			t.Errorf("%T: wrong form %q", store, body)
+		}
+		post := func(path string, form string, header string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("POST", path, strings.NewReader(form))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if header != "" {
+				r.Header.Set("X-CSRF-Token", header)
+			}
+			if cookie != nil {
+				r.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w
+		}
+		for _, tc := range []struct {
+			path, form, header string
+			cookie             *http.Cookie
+			code               int
+		}{
+			{"/", "csrf_token=" + token, "", cookie, 200},
+			{"/", "", token, cookie, 200},
+			{"/", "", "", cookie, 403},
+			{"/", "csrf_token=wrong", "", cookie, 403},
+			{"/?csrf_token=" + token, "", "", cookie, 403},
+			{"/", "csrf_token=" + token, "", nil, 403},
+			{"/", "csrf_token=", "", nil, 403},
+			{"/api/users", "", "", nil, 200},
+			{"/hook", "", "", nil, 200},
+			{"/hook/more", "", "", nil, 403},
+		} {
+			w := post(tc.path, tc.form, tc.header, tc.cookie)
+			if w.Code != tc.code {
+				t.Errorf("%T: %s %q %q: wanted %d but was %d", store, tc.path, tc.form, tc.header, tc.code, w.Code)
+			}
+			if w.Code == 403 && w.Body.String() != "denied 403" {
+				t.Errorf("%T: wrong error page %q", store, w.Body.String())
+			}
+		}
+	}
+	req := NewReqStub("GET", "/")
+	req.CSRFTokenString = "abc"
+	if req.CSRFToken() != "abc" {
+		t.Errorf("wrong ReqStub token")
+	}
+}
+
+func TestCSRFRegenerateSession(t *testing.T) {
+	cookieStore, _ := NewCookieStore(nil, bytes.Repeat([]byte("s"), 32))
+	for _, store := range []SessionStore{NewMemStore(), cookieStore} {
+		h, err := New(func(req Req) {
+			if req.Path() == "/login" {
+				req.RegenerateSession()
+				req.SetSessionValue("user", "chris")
+			}
+			req.SetHTML(req.CSRFToken())
+		}, WithSessionStore(store), WithCSRF(CSRFConfig{}), WithTemplatePattern(""), WithoutDefaultMiddleware())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		serve := func(method string, path string, token string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, path, nil)
+			r.Header.Set("X-CSRF-Token", token)
+			r.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		token, cookie := w.Body.String(), w.Result().Cookies()[0]
+		w = serve("POST", "/login", token, cookie)
+		if w.Code != 200 || w.Body.String() == token {
+			t.Fatalf("%T: wanted a new token but was %d %q", store, w.Code, w.Body.String())
+		}
+		newToken, newCookie := w.Body.String(), w.Result().Cookies()[0]
+		if w := serve("POST", "/", token, newCookie); w.Code != 403 {
+			t.Errorf("%T: wanted old token to be rejected but was %d", store, w.Code)
+		}
+		if w := serve("POST", "/", newToken, newCookie); w.Code != 200 {
+			t.Errorf("%T: wanted new token to be accepted but was %d", store, w.Code)
+		}
+	}
+}
+
+func TestReqAccessors(t *testing.T) {
+	var got []string
+	h, err := New(func(req Req) {
+		got = []string{req.Host(), req.Header("x-custom"), req.Cookie("theme"), req.Cookie("none"),
+			req.ClientIP(), req.UserAgent(), strings.Join(req.AcceptLanguages(), ","),
+			req.QueryValue("a"), req.PostFormValue("a"), req.FormValue("a")}
+		req.SetHTML("ok")
+	}, WithTrustedProxies("192.0.2.0/24"), WithTemplatePattern(""), WithoutDefaultMiddleware())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	r := httptest.NewRequest("POST", "http://example.com:8080/?a=query", strings.NewReader("a=body"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Custom", "custom")
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.Header.Set("User-Agent", "test/1.0")
+	r.Header.Set("Accept-Language", "en;q=0.8, de")
+	r.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	want := "example.com:8080 custom dark  203.0.113.7 test/1.0 de,en query body body"
+	if s := strings.Join(got, " "); s != want {
+		t.Errorf("wanted %q but was %q", want, s)
+	}
+	if _, err := New(nil, WithTrustedProxies("nonsense")); err == nil {
+		t.Errorf("wanted error for invalid trusted proxy")
+	}
+	req := NewReqStub("GET", "/")
+	req.HeaderMap.Set("User-Agent", "stub")
+	req.CookieMap["theme"] = "dark"
+	req.QueryValueMap["a"] = "query"
+	if req.UserAgent() != "stub" || req.Header("user-agent") != "stub" || req.Cookie("theme") != "dark" || req.QueryValue("a") != "query" || req.PostFormValue("a") != "" {
+		t.Errorf("wrong ReqStub accessors")
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	h, err := New(func(req Req) {
+		req.SetHeader("Cache-Control", "no-store")
+		req.AddHeader("X-Tag", "a")
+		req.AddHeader("X-Tag", "b")
+		req.SetCookie(&http.Cookie{Name: "theme", Value: "dark", Path: "/"})
+		req.DeleteCookie("old")
+		req.SetSessionValue("name", "chris")
+		switch req.Path() {
+		case "/missing":
+			req.SetStatus(http.StatusNotFound)
+		case "/panic":
+			panic("boom")
+		default:
+			req.SetHTML("ok")
+		}
+	}, WithTemplatePattern(""), WithoutDefaultMiddleware(), WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	for _, path := range []string{"/", "/missing"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("%s: wrong Cache-Control %q", path, cc)
+		}
+		if tags := w.Header().Values("X-Tag"); len(tags) != 2 || tags[1] != "b" {
+			t.Errorf("%s: wrong X-Tag %v", path, tags)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 3 || cookies[0].Name != DefaultCookieName || cookies[1].Value != "dark" || cookies[2].Name != "old" || cookies[2].MaxAge != -1 {
+			t.Errorf("%s: wrong cookies %v", path, cookies)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	if w.Code != 500 || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("wanted no headers for a panic but was %d %v", w.Code, w.Header())
+	}
+	req := NewReqStub("GET", "/")
+	req.SetHeader("Cache-Control", "no-store")
+	req.DeleteCookie("old")
+	if req.ResponseHeader.Get("Cache-Control") != "no-store" || len(req.CookieList) != 1 || req.CookieList[0].MaxAge != -1 {
+		t.Errorf("wrong ReqStub response headers")
+	}
+}
+
+func TestStatusResponses(t *testing.T) {
+	for _, dev := range []bool{false, true} {
+		h, err := New(func(req Req) {
+			switch req.Path() {
+			case "/html":
+				req.SetStatus(http.StatusNotFound)
+				req.SetHTML("not here")
+			case "/template":
+				req.SetTemplate("invalid.html")
+				req.SetStatus(http.StatusUnprocessableEntity)
+			case "/json":
+				req.SetJSONStatus(http.StatusCreated, 1)
+			case "/see-other":
+				req.SetRedirectStatus(http.StatusSeeOther, "/")
+			case "/temporary":
+				req.SetStatus(http.StatusTemporaryRedirect)
+				req.SetRedirect("/")
+			case "/found":
+				req.SetRedirect("/")
+			case "/conflict":
+				req.SetRedirect("/")
+				req.SetHTML("html")
+			case "/bad-redirect":
+				req.SetRedirectStatus(http.StatusNotFound, "/")
+			}
+		}, WithTemplates(fstest.MapFS{
+			"invalid.html": {Data: []byte(`invalid`)},
+		}, "*.html"), WithDevMode(dev), WithoutDefaultMiddleware(), WithLogger(slog.New(slog.DiscardHandler)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		want := map[string]string{
+			"/html":         "404 text/html; charset=utf-8 not here",
+			"/template":     "422 text/html; charset=utf-8 invalid",
+			"/json":         "201 application/json; charset=utf-8 1",
+			"/see-other":    "303 /",
+			"/temporary":    "307 /",
+			"/found":        "302 /",
+			"/conflict":     "200 text/html; charset=utf-8 html",
+			"/bad-redirect": "302 /",
+		}
+		if dev {
+			want["/conflict"] = "500"
+			want["/bad-redirect"] = "500"
+		}
+		for path, want := range want {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			got := fmt.Sprintf("%d %s %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+			if w.Code >= 300 && w.Code < 400 {
+				got = fmt.Sprintf("%d %s", w.Code, w.Header().Get("Location"))
+			} else if w.Code == 500 {
+				got = "500"
+			}
+			if got != want {
+				t.Errorf("dev %v %s: wanted %q but was %q", dev, path, want, got)
+			}
+		}
+	}
+	req := NewReqStub("GET", "/")
+	req.SetRedirectStatus(http.StatusSeeOther, "/")
+	if req.Redirect != "/" || req.Status != http.StatusSeeOther {
+		t.Errorf("wrong ReqStub redirect")
+	}
+}
+
+type closeTracker struct {
+	*strings.Reader
+	closed bool
+}
+
+func (ct *closeTracker) Close() error {
+	ct.closed = true
+	return nil
+}
+
+func TestContentResponses(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "report.csv")
+	if err := os.WriteFile(file, []byte("a,b\n1,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	reader := &closeTracker{Reader: strings.NewReader("reader content")}
+	h, err := New(func(req Req) {
+		switch req.Path() {
+		case "/bytes":
+			req.SetStatus(http.StatusCreated)
+			req.SetBytes("image/png", []byte("png"))
+		case "/sniff":
+			req.SetBytes("", []byte("<html>sniffed</html>"))
+		case "/file":
+			req.SetFile(file)
+			req.SetDownload("Bericht für 2020.csv")
+		case "/missing":
+			req.SetFile(filepath.Join(dir, "missing.csv"))
+			req.SetDownload("missing.csv")
+			req.SetHeader("Cache-Control", "max-age=3600")
+		case "/bad-json":
+			req.SetHeader("Cache-Control", "max-age=3600")
+			req.SetJSON(func() {})
+		case "/dir":
+			req.SetFile(dir)
+		case "/reader":
+			req.SetReader("notes.txt", modtime, reader)
+		case "/stream":
+			req.SetHeader("Content-Type", "text/csv")
+			req.SetStream(func(w io.Writer) error {
+				for i := 0; i < 3; i++ {
+					fmt.Fprintf(w, "%d\n", i)
+					w.(http.Flusher).Flush()
+				}
+				return nil
+			})
+		case "/stream-error":
+			req.SetDownload("export.csv")
+			req.SetStream(func(w io.Writer) error {
+				return fmt.Errorf("no database")
+			})
+		case "/stream-late-error":
+			req.SetStream(func(w io.Writer) error {
+				io.WriteString(w, "partial")
+				return fmt.Errorf("connection lost")
+			})
+		}
+	}, WithTemplatePattern(""), WithoutDefaultMiddleware(), WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	serve := func(path string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	for _, tc := range []struct {
+		path   string
+		header []string
+		want   string
+	}{
+		{"/bytes", nil, "201 image/png png"},
+		{"/sniff", nil, "200 text/html; charset=utf-8 <html>sniffed</html>"},
+		{"/file", nil, "200 text/csv; charset=utf-8 a,b\n1,2\n"},
+		{"/file", []string{"Range", "bytes=4-6"}, "206 text/csv; charset=utf-8 1,2"},
+		{"/missing", nil, "404 text/plain; charset=utf-8 Not Found\n"},
+		{"/dir", nil, "404 text/plain; charset=utf-8 Not Found\n"},
+		{"/reader", []string{"If-Modified-Since", modtime.Format(http.TimeFormat)}, "304  "},
+		{"/reader", nil, "200 text/plain; charset=utf-8 reader content"},
+		{"/stream", nil, "200 text/csv 0\n1\n2\n"},
+		{"/stream-error", nil, "500 text/plain; charset=utf-8 Internal Server Error\n"},
+		{"/stream-late-error", nil, "200 text/plain; charset=utf-8 partial"},
+	} {
+		w := serve(tc.path, tc.header...)
+		got := fmt.Sprintf("%d %s %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		if got != tc.want {
+			t.Errorf("%s %v: wanted %q but was %q", tc.path, tc.header, tc.want, got)
+		}
+	}
+	if cd := serve("/file").Header().Get("Content-Disposition"); cd != "attachment; filename*=utf-8''Bericht%20f%C3%BCr%202020.csv" {
+		t.Errorf("wrong Content-Disposition %q", cd)
+	}
+	for _, path := range []string{"/stream-error", "/missing", "/bad-json"} {
+		w := serve(path)
+		if w.Code < 400 || w.Header().Get("Content-Disposition") != "" || w.Header().Get("Cache-Control") != "" {
+			t.Errorf("%s: wanted error page without headers but was %d %v", path, w.Code, w.Header())
+		}
+	}
+	if !reader.closed {
+		t.Errorf("wanted reader to be closed")
+	}
+	req := NewReqStub("GET", "/")
+	req.SetBytes("text/csv", []byte("a,b"))
+	req.SetDownload("export.csv")
+	req.SetStream(func(w io.Writer) error {
+		_, err := io.WriteString(w, "streamed")
+		return err
+	})
+	var buf bytes.Buffer
+	if err := req.Stream(&buf); err != nil || buf.String() != "streamed" {
+		t.Errorf("wrong ReqStub stream %q", buf.String())
+	}
+	if req.ContentType != "text/csv" || string(req.Bytes) != "a,b" || req.Download != "export.csv" {
+		t.Errorf("wrong ReqStub content")
+	}
+}
+
+func TestSessionAccessors(t *testing.T) {
+	cookieStore, _ := NewCookieStore(nil, bytes.Repeat([]byte("s"), 32))
+	for _, store := range []SessionStore{NewMemStore(), cookieStore, sessionStoreWithoutTTL{NewMemStore()}} {
+		var body string
+		h, err := New(func(req Req) {
+			if _, ok := SessionGet[string](req, "name"); ok {
+				t.Errorf("%T: wanted no name without session", store)
+			}
+			req.SetSessionValue("name", "chris")
+			req.SetSessionValue("age", 42)
+			req.AddFlash("info", "hello")
+			name, ok := SessionGet[string](req, "name")
+			if !ok || name != "chris" {
+				t.Errorf("%T: wrong name %q", store, name)
+			}
+			if _, ok := SessionGet[string](req, "age"); ok {
+				t.Errorf("%T: wanted age not to be a string", store)
+			}
+			body = strings.Join(SessionKeys(req), ",")
+			SessionDelete(req, "age")
+			body += " " + strings.Join(SessionKeys(req), ",")
+			token := req.CSRFToken()
+			SessionClear(req)
+			body += " " + strings.Join(SessionKeys(req), ",") + fmt.Sprint(len(req.Flashes()))
+			if req.CSRFToken() != token {
+				t.Errorf("%T: wanted CSRF token to survive ClearSession", store)
+			}
+			req.SetModelValue("n", 1)
+			if n, ok := ModelGet[int](req, "n"); !ok || n != 1 {
+				t.Errorf("wrong model value %d", n)
+			}
+			if _, ok := ModelGet[string](req, "n"); ok {
+				t.Errorf("wanted model value not to be a string")
+			}
+			req.SetHTML("ok")
+		}, WithSessionStore(store), WithTemplatePattern(""), WithoutDefaultMiddleware())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if body != "age,name name 1" {
+			t.Errorf("%T: wrong keys %q", store, body)
+		}
+	}
+	req := NewReqStub("GET", "/")
+	req.SetSessionValue("name", "chris")
+	req.SetSessionValue("_internal", 1)
+	if keys := SessionKeys(req); len(keys) != 1 || keys[0] != "name" {
+		t.Errorf("wrong ReqStub keys %v", keys)
+	}
+	SessionClear(req)
+	if _, ok := SessionGet[string](req, "name"); ok || req.SessionMap["_internal"] != 1 {
+		t.Errorf("wanted cleared ReqStub session with reserved values")
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	store := NewMemStore()
+	store.SetIdleTimeout(time.Millisecond)
+	store.PutValue("", "name", "chris")
+	h, err := New(nil, WithSessionStore(store), WithTemplatePattern(""), WithJanitorInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(store.GetSessionInfos()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := len(store.GetSessionInfos()); n != 0 {
+		t.Errorf("expected janitor to expire the session, but have %d sessions", n)
+	}
+	h.Close()
+}
+
+func TestJanitorSkipped(t *testing.T) {
+	cookieStore, err := NewCookieStore(nil, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := []SessionStore{cookieStore, NewRedisStore("127.0.0.1:0", nil)}
+	for _, store := range stores {
+		h, err := New(nil, WithSessionStore(store), WithTemplatePattern(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.janitor != nil {
+			t.Errorf("%T: wanted no janitor", store)
+		}
+		h.Close()
+	}
+	h, err := New(nil, WithTemplatePattern(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if h.janitor == nil {
+		t.Errorf("MemStore: wanted a janitor")
+	}
+}